@@ -0,0 +1,200 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A ReplyCallback receives the reply to a request sent with SendAsync. If no
+// reply arrived before the request's timeout, the reply's Error.Code will be
+// CommonErrorCode_TIMEOUT.
+type ReplyCallback func(reply *BusMessage)
+
+// PendingReply is a request sent with SendAsync that hasn't received a reply
+type PendingReply struct {
+	replyTo  int64
+	topic    string
+	reqType  int32
+	deadline time.Time
+	callback ReplyCallback
+}
+
+// The correlation IDs generated by nextReplyTo are firstReplyTo through
+// lastReplyTo. pendingLock guards them and pendingReplies.
+var (
+	pendingLock    sync.Mutex
+	pendingReplies = map[int64]*PendingReply{}
+	firstReplyTo   int64
+	lastReplyTo    int64
+)
+
+// ReplyTo returns the correlation ID the request was sent with
+func (p *PendingReply) ReplyTo() int64 {
+	return p.replyTo
+}
+
+// Cancel stops waiting for the reply. The callback will not be called.
+func (p *PendingReply) Cancel() {
+	pendingLock.Lock()
+	delete(pendingReplies, p.replyTo)
+	pendingLock.Unlock()
+}
+
+// nextReplyTo generates a correlation ID. IDs are seeded from the clock so
+// they're unlikely to match those from a previous instance of the plugin.
+func nextReplyTo() int64 {
+	pendingLock.Lock()
+	defer pendingLock.Unlock()
+	if lastReplyTo == 0 {
+		lastReplyTo = time.Now().UnixNano() & 0x7fffffffffff0000
+		firstReplyTo = lastReplyTo + 1
+	}
+	lastReplyTo++
+	return lastReplyTo
+}
+
+// isLateReply reports whether msg is a reply to a request this plugin sent
+// with SendAsync that is no longer pending, because it timed out or was
+// cancelled
+func isLateReply(msg *BusMessage) bool {
+	if msg.ReplyTo == nil || pendingFor(msg) != nil {
+		return false
+	}
+	id := msg.GetReplyTo()
+	pendingLock.Lock()
+	defer pendingLock.Unlock()
+	return firstReplyTo != 0 && id >= firstReplyTo && id <= lastReplyTo
+}
+
+// SendAsync sends msg with a generated ReplyTo using Send and returns without
+// waiting for a reply. When a reply with the same topic and ReplyTo is passed
+// to HandleReply, callback is invoked with it. If timeoutMS milliseconds pass
+// without a reply, callback is invoked with a CommonErrorCode_TIMEOUT error
+// the next time HandleReply or ExpirePending is called. A timeoutMS of 0 means
+// the request never times out.
+func SendAsync(msg *BusMessage, timeoutMS uint64, callback ReplyCallback) (*PendingReply, error) {
+	replyTo := nextReplyTo()
+	msg.ReplyTo = &replyTo
+	p := &PendingReply{
+		replyTo:  replyTo,
+		topic:    msg.GetTopic(),
+		reqType:  msg.GetType(),
+		callback: callback,
+	}
+	if timeoutMS > 0 {
+		p.deadline = time.Now().Add(time.Duration(timeoutMS) * time.Millisecond)
+	}
+	if err := Send(msg); err != nil {
+		return nil, fmt.Errorf("sending: %w", err)
+	}
+	pendingLock.Lock()
+	pendingReplies[replyTo] = p
+	pendingLock.Unlock()
+	return p, nil
+}
+
+// SendAsyncWrap is like WaitForReplyWrap, but uses SendAsync. The process
+// function is called when the reply arrives or the request times out. An error
+// unmarshalling the reply is passed to process as a CommonErrorCode_INVALID_TYPE
+// *Error.
+func SendAsyncWrap[M any, REQ Marshaller, RESP UnmarshallerPTR[M]](
+	msg *BusMessage, req REQ, process func(RESP, *Error), timeoutMS uint64,
+) (*PendingReply, error) {
+	var err error
+	msg.Message, err = req.MarshalVT()
+	if err != nil {
+		return nil, fmt.Errorf("marshalling: %w", err)
+	}
+	return SendAsync(msg, timeoutMS, func(reply *BusMessage) {
+		if reply.Error != nil {
+			process(nil, reply.Error)
+			return
+		}
+		var resp M
+		if busErr := UnmarshalMessage(reply, RESP(&resp)); busErr != nil {
+			process(nil, busErr)
+			return
+		}
+		process(&resp, nil)
+	})
+}
+
+// HandleReply checks whether msg is the reply to a request sent with
+// SendAsync. If it is, the request's callback is invoked and true is returned.
+// Expired requests are processed first as with ExpirePending. TopicRouter.Handle
+// calls this before dispatching messages.
+func HandleReply(msg *BusMessage) bool {
+	ExpirePending()
+	pendingLock.Lock()
+	p := pendingForLocked(msg)
+	if p != nil {
+		delete(pendingReplies, p.replyTo)
+	}
+	pendingLock.Unlock()
+	if p == nil {
+		return false
+	}
+	p.callback(msg)
+	return true
+}
+
+// pendingFor returns the request msg is a reply to, or nil if there isn't one
+func pendingFor(msg *BusMessage) *PendingReply {
+	pendingLock.Lock()
+	defer pendingLock.Unlock()
+	return pendingForLocked(msg)
+}
+
+// pendingForLocked implements pendingFor with pendingLock held
+func pendingForLocked(msg *BusMessage) *PendingReply {
+	if msg.ReplyTo == nil {
+		return nil
+	}
+	p, present := pendingReplies[msg.GetReplyTo()]
+	if !present || p.topic != msg.GetTopic() || p.reqType == msg.GetType() {
+		return nil
+	}
+	return p
+}
+
+// ExpirePending invokes the callback with a CommonErrorCode_TIMEOUT error for
+// every request sent with SendAsync whose timeout has passed. Plugins that
+// receive few messages may want to call this periodically.
+func ExpirePending() {
+	now := time.Now()
+	var expired []*PendingReply
+	pendingLock.Lock()
+	for _, p := range pendingReplies {
+		if !p.deadline.IsZero() && now.After(p.deadline) {
+			expired = append(expired, p)
+			delete(pendingReplies, p.replyTo)
+		}
+	}
+	pendingLock.Unlock()
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].replyTo < expired[j].replyTo
+	})
+	for _, p := range expired {
+		replyTo := p.replyTo
+		detail := "timed out waiting for reply"
+		p.callback(&BusMessage{
+			Topic:   p.topic,
+			Type:    p.reqType + 1,
+			ReplyTo: &replyTo,
+			Error: &Error{
+				Code:   int32(CommonErrorCode_TIMEOUT),
+				Detail: &detail,
+			},
+		})
+	}
+}
+
+// PendingCount returns the number of requests sent with SendAsync that are
+// still waiting for a reply.
+func PendingCount() int {
+	pendingLock.Lock()
+	defer pendingLock.Unlock()
+	return len(pendingReplies)
+}
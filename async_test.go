@@ -0,0 +1,109 @@
+//go:build !wasm
+
+package core_test
+
+import (
+	"testing"
+	"time"
+
+	core "github.com/autonomouskoi/core-tinygo"
+	"github.com/autonomouskoi/core-tinygo/coretest"
+)
+
+func TestHandleReplyMatching(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		topic     string
+		msgType   int32
+		wantMatch bool
+	}{
+		{"reply", "t", 2, true},
+		{"other topic", "u", 2, false},
+		{"request echoed", "t", 1, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := coretest.New(t)
+			var got *core.BusMessage
+			p, err := core.SendAsync(&core.BusMessage{Topic: "t", Type: 1}, 0, func(reply *core.BusMessage) {
+				got = reply
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer p.Cancel()
+			sent := h.SentTo("t")
+			if len(sent) != 1 || sent[0].GetReplyTo() != p.ReplyTo() {
+				t.Fatalf("got sent %v, want one request with ReplyTo %d", sent, p.ReplyTo())
+			}
+			replyTo := p.ReplyTo()
+			msg := &core.BusMessage{Topic: tc.topic, Type: tc.msgType, ReplyTo: &replyTo}
+			if matched := core.HandleReply(msg); matched != tc.wantMatch {
+				t.Fatalf("HandleReply returned %t, want %t", matched, tc.wantMatch)
+			}
+			if (got == msg) != tc.wantMatch {
+				t.Errorf("callback got %v", got)
+			}
+			// a reply is only delivered once
+			if tc.wantMatch && core.HandleReply(msg) {
+				t.Error("reply delivered twice")
+			}
+		})
+	}
+}
+
+func TestSendAsyncTimeout(t *testing.T) {
+	coretest.New(t)
+	var got []*core.BusMessage
+	callback := func(reply *core.BusMessage) { got = append(got, reply) }
+	never, err := core.SendAsync(&core.BusMessage{Topic: "t", Type: 1}, 0, callback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer never.Cancel()
+	p, err := core.SendAsync(&core.BusMessage{Topic: "t", Type: 3}, 1, callback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := core.PendingCount()
+	time.Sleep(5 * time.Millisecond)
+	core.ExpirePending()
+	if len(got) != 1 {
+		t.Fatalf("got %d callbacks, want 1", len(got))
+	}
+	reply := got[0]
+	if reply.GetError().GetCode() != int32(core.CommonErrorCode_TIMEOUT) {
+		t.Errorf("got error %v, want TIMEOUT", reply.GetError())
+	}
+	if reply.GetTopic() != "t" || reply.GetType() != 4 || reply.GetReplyTo() != p.ReplyTo() {
+		t.Errorf("got topic %q type %d ReplyTo %d", reply.GetTopic(), reply.GetType(), reply.GetReplyTo())
+	}
+	if core.PendingCount() != before-1 {
+		t.Errorf("got %d pending, want %d", core.PendingCount(), before-1)
+	}
+	// a reply after the timeout isn't delivered
+	replyTo := p.ReplyTo()
+	if core.HandleReply(&core.BusMessage{Topic: "t", Type: 4, ReplyTo: &replyTo}) || len(got) != 1 {
+		t.Error("late reply delivered")
+	}
+}
+
+func TestPendingReplyCancel(t *testing.T) {
+	coretest.New(t)
+	p, err := core.SendAsync(&core.BusMessage{Topic: "t", Type: 1}, 1, func(*core.BusMessage) {
+		t.Error("callback called after Cancel")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := core.PendingCount()
+	p.Cancel()
+	if core.PendingCount() != before-1 {
+		t.Errorf("got %d pending, want %d", core.PendingCount(), before-1)
+	}
+	time.Sleep(5 * time.Millisecond)
+	core.ExpirePending()
+	replyTo := p.ReplyTo()
+	if core.HandleReply(&core.BusMessage{Topic: "t", Type: 2, ReplyTo: &replyTo}) {
+		t.Error("reply to a cancelled request handled")
+	}
+}
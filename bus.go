@@ -2,27 +2,15 @@ package core
 
 import (
 	"fmt"
-
-	"github.com/extism/go-pdk"
 )
 
-//go:wasmimport extism:host/user send
-func send(busMessage uint64)
-
-//go:wasmimport extism:host/user send_reply
-func sendReply(busMessage uint64)
-
-//go:wasmimport extism:host/user wait_for_reply
-func waitForReply(busMessage uint64, timeoutMS uint64) uint64
-
 // Send a BusMessage to the host
 func Send(msg *BusMessage) error {
-	mem, err := MarshalArg(msg)
+	b, err := msg.MarshalVT()
 	if err != nil {
 		return fmt.Errorf("marshalling: %w", err)
 	}
-	send(mem.Offset())
-	mem.Free()
+	hostSend(b)
 	return nil
 }
 
@@ -30,12 +18,11 @@ func Send(msg *BusMessage) error {
 // received. The ReplyTo field should be set to the value from the received
 // message.
 func SendReply(msg *BusMessage) error {
-	mem, err := MarshalArg(msg)
+	b, err := msg.MarshalVT()
 	if err != nil {
 		return fmt.Errorf("marshalling: %w", err)
 	}
-	sendReply(mem.Offset())
-	mem.Free()
+	hostSendReply(b)
 	return nil
 }
 
@@ -43,13 +30,13 @@ func SendReply(msg *BusMessage) error {
 // received within timeoutMS milliseconds, the returned BusMessage.Error.Code
 // will be CommonErrorCode_TIMEOUT.
 func WaitForReply(msg *BusMessage, timeoutMS uint64) (*BusMessage, error) {
-	mem, err := MarshalArg(msg)
+	b, err := msg.MarshalVT()
 	if err != nil {
 		return nil, fmt.Errorf("marshalling: %w", err)
 	}
-	defer mem.Free()
-	offs := waitForReply(mem.Offset(), timeoutMS)
-	return UnmarshalReturn(offs)
+	reply := &BusMessage{}
+	err = reply.UnmarshalVT(hostWaitForReply(b, timeoutMS))
+	return reply, err
 }
 
 // Marshaller represents a proto that can be marshalled, suitable for tinygo.
@@ -123,35 +110,12 @@ func Unsubscribe(topic string) error {
 		return err
 	}
 	msg := &BusMessage{
-		Type:    int32(ExternalMessageType_SUBSCRIBE_REQ),
+		Type:    int32(ExternalMessageType_UNSUBSCRIBE_REQ),
 		Message: b,
 	}
 	return Send(msg)
 }
 
-// MarshalArg marshals the provided argument for passing as an argument to an
-// invocation of a host function. You probably want to use Send, SendReply, or
-// WaitForReply instead.
-func MarshalArg(msg *BusMessage) (pdk.Memory, error) {
-	b, err := msg.MarshalVT()
-	if err != nil {
-		return pdk.Memory{}, err
-	}
-	mem := pdk.AllocateBytes(b)
-	return mem, nil
-}
-
-// UnmarshalReturn unmarshals a message provided as the return value of the
-// invocation of a host function. You probably want to use Send, SendReply, or
-// WaitForReply instead.
-func UnmarshalReturn(offs uint64) (*BusMessage, error) {
-	mem := pdk.FindMemory(offs)
-	defer mem.Free()
-	msg := &BusMessage{}
-	err := msg.UnmarshalVT(mem.ReadBytes())
-	return msg, err
-}
-
 // Error implements the built in error interface
 func (e *Error) Error() string {
 	return e.GetDetail()
@@ -0,0 +1,191 @@
+//go:build !wasm
+
+// Package coretest provides an in-memory plugin host so code built on the
+// core package can be tested natively with go test.
+package coretest
+
+import (
+	"sort"
+	"sync"
+	"testing"
+
+	core "github.com/autonomouskoi/core-tinygo"
+)
+
+type handlerKey struct {
+	topic   string
+	msgType int32
+}
+
+// Host is an in-memory implementation of core.Host. It has a KV store, a set
+// of subscriptions, a captured log stream, and an outbox of messages sent by
+// the plugin. KV, subscribe, unsubscribe, and log requests are handled by the
+// Host itself. Replies to other requests made with core.WaitForReply can be
+// provided with Handle.
+type Host struct {
+	lock          sync.Mutex
+	kv            map[string][]byte
+	subscriptions map[string]struct{}
+	logs          []*core.LogSendRequest
+	sent          []*core.BusMessage
+	replies       []*core.BusMessage
+	handlers      map[handlerKey]core.Handler
+}
+
+// NewHost creates an empty Host. Use core.SetHost to make it the active host,
+// or use New.
+func NewHost() *Host {
+	return &Host{
+		kv:            map[string][]byte{},
+		subscriptions: map[string]struct{}{},
+		handlers:      map[handlerKey]core.Handler{},
+	}
+}
+
+// New creates an empty Host and sets it as the active host for the core
+// package. The previous host is restored when the test completes.
+func New(tb testing.TB) *Host {
+	h := NewHost()
+	prev := core.SetHost(h)
+	tb.Cleanup(func() { core.SetHost(prev) })
+	return h
+}
+
+// Handle registers handler to provide the reply to requests made with
+// core.WaitForReply for the given topic and message type. Requests with an
+// empty topic are directed at the host, e.g. services from the svc package.
+// A handler returning nil results in a timeout error.
+func (h *Host) Handle(topic string, msgType int32, handler core.Handler) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.handlers[handlerKey{topic: topic, msgType: msgType}] = handler
+}
+
+// Send implements core.Host. Subscribe, unsubscribe, and log requests are
+// applied to the Host, other messages are added to the outbox.
+func (h *Host) Send(msg *core.BusMessage) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if msg.GetTopic() == "" {
+		switch core.ExternalMessageType(msg.GetType()) {
+		case core.ExternalMessageType_SUBSCRIBE_REQ:
+			req := &core.SubscribeRequest{}
+			if err := req.UnmarshalVT(msg.GetMessage()); err == nil {
+				h.subscriptions[req.GetTopic()] = struct{}{}
+				return
+			}
+		case core.ExternalMessageType_UNSUBSCRIBE_REQ:
+			req := &core.UnsubscribeRequest{}
+			if err := req.UnmarshalVT(msg.GetMessage()); err == nil {
+				delete(h.subscriptions, req.GetTopic())
+				return
+			}
+		case core.ExternalMessageType_LOG_SEND_REQ:
+			req := &core.LogSendRequest{}
+			if err := req.UnmarshalVT(msg.GetMessage()); err == nil {
+				h.logs = append(h.logs, req)
+				return
+			}
+		}
+	}
+	h.sent = append(h.sent, msg)
+}
+
+// SendReply implements core.Host, adding msg to the replies.
+func (h *Host) SendReply(msg *core.BusMessage) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.replies = append(h.replies, msg)
+}
+
+// WaitForReply implements core.Host. KV requests are served from the Host's
+// KV store. Other requests are added to the outbox and passed to the handler
+// registered with Handle, if any.
+func (h *Host) WaitForReply(msg *core.BusMessage, timeoutMS uint64) *core.BusMessage {
+	if msg.GetTopic() == "" {
+		switch core.ExternalMessageType(msg.GetType()) {
+		case core.ExternalMessageType_KV_GET_REQ:
+			return h.kvGet(msg)
+		case core.ExternalMessageType_KV_SET_REQ:
+			return h.kvSet(msg)
+		case core.ExternalMessageType_KV_LIST_REQ:
+			return h.kvList(msg)
+		case core.ExternalMessageType_KV_DELETE_REQ:
+			return h.kvDelete(msg)
+		}
+	}
+	h.lock.Lock()
+	h.sent = append(h.sent, msg)
+	handler, present := h.handlers[handlerKey{topic: msg.GetTopic(), msgType: msg.GetType()}]
+	h.lock.Unlock()
+	// called without the lock held so the handler can use the core package
+	if !present {
+		return nil
+	}
+	return handler(msg)
+}
+
+// Sent returns the messages sent by the plugin that weren't handled by the
+// Host itself, in the order they were sent.
+func (h *Host) Sent() []*core.BusMessage {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return append([]*core.BusMessage(nil), h.sent...)
+}
+
+// SentTo returns the messages from Sent with the given topic.
+func (h *Host) SentTo(topic string) []*core.BusMessage {
+	var msgs []*core.BusMessage
+	for _, msg := range h.Sent() {
+		if msg.GetTopic() == topic {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
+
+// Replies returns the messages sent by the plugin with core.SendReply, in the
+// order they were sent.
+func (h *Host) Replies() []*core.BusMessage {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return append([]*core.BusMessage(nil), h.replies...)
+}
+
+// Logs returns the log requests sent by the plugin, in the order they were
+// sent.
+func (h *Host) Logs() []*core.LogSendRequest {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return append([]*core.LogSendRequest(nil), h.logs...)
+}
+
+// Subscribed reports whether the plugin is subscribed to topic
+func (h *Host) Subscribed(topic string) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	_, present := h.subscriptions[topic]
+	return present
+}
+
+// Subscriptions returns the topics the plugin is subscribed to, sorted.
+func (h *Host) Subscriptions() []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	topics := make([]string, 0, len(h.subscriptions))
+	for topic := range h.subscriptions {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// ClearOutbox discards the captured sent messages, replies, and logs. The KV
+// store and subscriptions are retained.
+func (h *Host) ClearOutbox() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.sent = nil
+	h.replies = nil
+	h.logs = nil
+}
@@ -0,0 +1,124 @@
+//go:build !wasm
+
+package coretest_test
+
+import (
+	"slices"
+	"testing"
+
+	core "github.com/autonomouskoi/core-tinygo"
+	"github.com/autonomouskoi/core-tinygo/coretest"
+)
+
+func TestKVList(t *testing.T) {
+	h := coretest.New(t)
+	for _, key := range []string{"b/2", "a/1", "b/1", "b/3", "c"} {
+		h.KVSet([]byte(key), nil)
+	}
+	for _, tc := range []struct {
+		name          string
+		prefix        string
+		limit, offset int
+		want          []string
+		wantTotal     uint32
+	}{
+		{"all", "", 0, 0, []string{"a/1", "b/1", "b/2", "b/3", "c"}, 5},
+		{"prefix", "b/", 0, 0, []string{"b/1", "b/2", "b/3"}, 3},
+		{"limit", "b/", 2, 0, []string{"b/1", "b/2"}, 3},
+		{"offset", "b/", 0, 1, []string{"b/2", "b/3"}, 3},
+		{"limit and offset", "b/", 1, 1, []string{"b/2"}, 3},
+		{"limit past end", "b/", 5, 2, []string{"b/3"}, 3},
+		{"offset past end", "b/", 0, 3, nil, 3},
+		{"no matches", "d", 0, 0, nil, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := core.KVList([]byte(tc.prefix), tc.limit, tc.offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, key := range resp.GetKeys() {
+				got = append(got, string(key))
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("got keys %q, want %q", got, tc.want)
+			}
+			if resp.GetTotalMatches() != tc.wantTotal {
+				t.Errorf("got %d total matches, want %d", resp.GetTotalMatches(), tc.wantTotal)
+			}
+		})
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	h := coretest.New(t)
+	for _, topic := range []string{"a", "b", "a"} {
+		if err := core.Send(&core.BusMessage{Topic: topic, Type: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := core.Subscribe("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := core.SendReply(&core.BusMessage{Topic: "a", Type: 2}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		got  int
+		want int
+	}{
+		{"sent", len(h.Sent()), 3},
+		{"sent to a", len(h.SentTo("a")), 2},
+		{"sent to c", len(h.SentTo("c")), 0},
+		{"replies", len(h.Replies()), 1},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("%s: got %d messages, want %d", tc.name, tc.got, tc.want)
+		}
+	}
+	// subscriptions are handled by the host rather than sent
+	if !h.Subscribed("a") || h.Subscribed("b") {
+		t.Errorf("got subscriptions %q, want [a]", h.Subscriptions())
+	}
+	h.ClearOutbox()
+	if len(h.Sent()) != 0 || len(h.Replies()) != 0 {
+		t.Error("outbox not cleared")
+	}
+	if !h.Subscribed("a") {
+		t.Error("ClearOutbox removed subscriptions")
+	}
+}
+
+func TestLogs(t *testing.T) {
+	h := coretest.New(t)
+	if err := core.LogInfo("hello", "n", int64(3), "who", "world"); err != nil {
+		t.Fatal(err)
+	}
+	if err := core.LogError("oops"); err != nil {
+		t.Fatal(err)
+	}
+	logs := h.Logs()
+	if len(logs) != 2 {
+		t.Fatalf("got %d logs, want 2", len(logs))
+	}
+	for i, tc := range []struct {
+		level   core.LogLevel
+		message string
+		args    int
+	}{
+		{core.LogLevel_INFO, "hello", 2},
+		{core.LogLevel_ERROR, "oops", 0},
+	} {
+		got := logs[i]
+		if got.GetLevel() != tc.level || got.GetMessage() != tc.message || len(got.GetArgs()) != tc.args {
+			t.Errorf("log %d: got %v %q with %d args", i, got.GetLevel(), got.GetMessage(), len(got.GetArgs()))
+		}
+	}
+	if got := logs[0].GetArgs()[1].GetString_(); got != "world" {
+		t.Errorf("got arg %q, want %q", got, "world")
+	}
+	if len(h.Sent()) != 0 {
+		t.Error("logs added to the outbox")
+	}
+}
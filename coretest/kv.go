@@ -0,0 +1,128 @@
+//go:build !wasm
+
+package coretest
+
+import (
+	"bytes"
+	"sort"
+
+	core "github.com/autonomouskoi/core-tinygo"
+)
+
+// KVGet returns the value stored with key and whether it's present
+func (h *Host) KVGet(key []byte) ([]byte, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	value, present := h.kv[string(key)]
+	return bytes.Clone(value), present
+}
+
+// KVSet stores value with key, bypassing the plugin. This is useful for
+// setting up state before a test.
+func (h *Host) KVSet(key, value []byte) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.kv[string(key)] = bytes.Clone(value)
+}
+
+// KVKeys returns all keys in the KV store, sorted.
+func (h *Host) KVKeys() [][]byte {
+	return h.kvMatches(nil)
+}
+
+func (h *Host) kvMatches(prefix []byte) [][]byte {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var keys [][]byte
+	for key := range h.kv {
+		if bytes.HasPrefix([]byte(key), prefix) {
+			keys = append(keys, []byte(key))
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+	return keys
+}
+
+func kvReply(msg *core.BusMessage, resp core.Marshaller) *core.BusMessage {
+	b, err := resp.MarshalVT()
+	if err != nil {
+		return kvInvalid(msg, err)
+	}
+	reply := core.DefaultReply(msg)
+	reply.Message = b
+	return reply
+}
+
+func kvInvalid(msg *core.BusMessage, err error) *core.BusMessage {
+	reply := core.DefaultReply(msg)
+	errStr := err.Error()
+	reply.Error = &core.Error{
+		Code:   int32(core.CommonErrorCode_INVALID_TYPE),
+		Detail: &errStr,
+	}
+	return reply
+}
+
+func (h *Host) kvGet(msg *core.BusMessage) *core.BusMessage {
+	req := &core.KVGetRequest{}
+	if err := req.UnmarshalVT(msg.GetMessage()); err != nil {
+		return kvInvalid(msg, err)
+	}
+	value, present := h.KVGet(req.GetKey())
+	if !present {
+		reply := core.DefaultReply(msg)
+		reply.Error = &core.Error{Code: int32(core.CommonErrorCode_NOT_FOUND)}
+		return reply
+	}
+	return kvReply(msg, &core.KVGetResponse{
+		Key:   req.GetKey(),
+		Value: value,
+	})
+}
+
+func (h *Host) kvSet(msg *core.BusMessage) *core.BusMessage {
+	req := &core.KVSetRequest{}
+	if err := req.UnmarshalVT(msg.GetMessage()); err != nil {
+		return kvInvalid(msg, err)
+	}
+	h.KVSet(req.GetKey(), req.GetValue())
+	return kvReply(msg, &core.KVSetResponse{})
+}
+
+// kvList honors the same prefix, offset, and limit semantics as the host:
+// matching keys are sorted, offset matches are skipped, and at most limit
+// keys are returned unless limit is 0.
+func (h *Host) kvList(msg *core.BusMessage) *core.BusMessage {
+	req := &core.KVListRequest{}
+	if err := req.UnmarshalVT(msg.GetMessage()); err != nil {
+		return kvInvalid(msg, err)
+	}
+	matches := h.kvMatches(req.GetPrefix())
+	resp := &core.KVListResponse{
+		Prefix:       req.GetPrefix(),
+		TotalMatches: uint32(len(matches)),
+		Offset:       req.GetOffset(),
+		Limit:        req.GetLimit(),
+	}
+	if offset := int(req.GetOffset()); offset < len(matches) {
+		matches = matches[offset:]
+		if limit := int(req.GetLimit()); limit > 0 && limit < len(matches) {
+			matches = matches[:limit]
+		}
+		resp.Keys = matches
+	}
+	return kvReply(msg, resp)
+}
+
+func (h *Host) kvDelete(msg *core.BusMessage) *core.BusMessage {
+	req := &core.KVDeleteRequest{}
+	if err := req.UnmarshalVT(msg.GetMessage()); err != nil {
+		return kvInvalid(msg, err)
+	}
+	h.lock.Lock()
+	delete(h.kv, string(req.GetKey()))
+	h.lock.Unlock()
+	return kvReply(msg, &core.KVDeleteResponse{})
+}
@@ -0,0 +1,248 @@
+// Package counters provides counters, windowed counters, and token bucket
+// rate limiters persisted in KV, such as for chat command cooldowns and
+// per-user limits. Values are kept in memory once read, so reads and denied
+// limiter requests don't go to the host; changes are written through to KV.
+// A Store assumes it's the only writer of its keys.
+package counters
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/autonomouskoi/akcore"
+	core "github.com/autonomouskoi/core-tinygo"
+)
+
+// Within a Store's namespace, counters are stored under counterPrefix,
+// windowed counters under windowPrefix followed by the window in
+// milliseconds, and limiter buckets under limiterPrefix followed by the
+// limiter's name.
+const (
+	counterPrefix = "c/"
+	windowPrefix  = "w/"
+	limiterPrefix = "b/"
+)
+
+// An Option configures a Store
+type Option func(*Store)
+
+// Clock sets the function the Store uses to get the current time, for
+// windowed counters and limiters. The default is time.Now. Tests can use it
+// to control time.
+func Clock(now func() time.Time) Option {
+	return func(s *Store) {
+		s.now = now
+	}
+}
+
+// MaxCached sets how many values of each kind a Store keeps in memory: n
+// counters, n windowed counters, and n buckets for each Limiter. When one is
+// full, an arbitrary value is evicted from memory and read from KV again the
+// next time it's used. The default is DefaultMaxCached. If n is 0, values are
+// never evicted.
+func MaxCached(n int) Option {
+	return func(s *Store) {
+		s.maxCached = n
+	}
+}
+
+// DefaultMaxCached is the number of values of each kind a Store keeps in
+// memory unless configured with MaxCached.
+const DefaultMaxCached = 1024
+
+// cachePut sets m[key] to v, first evicting an arbitrary entry if m already
+// holds max entries and key isn't one of them.
+func cachePut[V any](m map[string]V, max int, key string, v V) {
+	if _, present := m[key]; !present && max > 0 && len(m) >= max {
+		for evict := range m {
+			delete(m, evict)
+			break
+		}
+	}
+	m[key] = v
+}
+
+type windowed struct {
+	start int64
+	count int64
+}
+
+// A Store holds counters and limiters
+type Store struct {
+	kv        *core.KVStore
+	now       func() time.Time
+	maxCached int
+	counts    map[string]int64
+	windows   map[string]windowed
+}
+
+// New creates a Store keeping its values in kv under prefix. If kv is nil,
+// core.DefaultKV is used.
+func New(kv *core.KVStore, prefix []byte, opts ...Option) *Store {
+	if kv == nil {
+		kv = core.DefaultKV
+	}
+	s := &Store{
+		kv:        kv.With(core.KVNamespace(prefix)),
+		now:       time.Now,
+		maxCached: DefaultMaxCached,
+		counts:    map[string]int64{},
+		windows:   map[string]windowed{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// getInt64 gets the varint stored with key, or 0 if there's none
+func (s *Store) getInt64(key []byte) (int64, error) {
+	b, err := s.kv.Get(key)
+	if errors.Is(err, akcore.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	v, n := binary.Varint(b)
+	if n <= 0 {
+		return 0, fmt.Errorf("invalid value for %q", key)
+	}
+	return v, nil
+}
+
+// Get returns the value of the named counter. A counter that has never been
+// changed is 0.
+func (s *Store) Get(name string) (int64, error) {
+	if v, present := s.counts[name]; present {
+		return v, nil
+	}
+	v, err := s.getInt64([]byte(counterPrefix + name))
+	if err != nil {
+		return 0, fmt.Errorf("getting counter %s: %w", name, err)
+	}
+	cachePut(s.counts, s.maxCached, name, v)
+	return v, nil
+}
+
+// set sets the named counter to v
+func (s *Store) set(name string, v int64) error {
+	if err := s.kv.Set([]byte(counterPrefix+name), binary.AppendVarint(nil, v)); err != nil {
+		delete(s.counts, name)
+		return fmt.Errorf("setting counter %s: %w", name, err)
+	}
+	cachePut(s.counts, s.maxCached, name, v)
+	return nil
+}
+
+// Add adds delta to the named counter, returning the new value
+func (s *Store) Add(name string, delta int64) (int64, error) {
+	v, err := s.Get(name)
+	if err != nil {
+		return 0, err
+	}
+	v += delta
+	return v, s.set(name, v)
+}
+
+// Increment adds 1 to the named counter, returning the new value
+func (s *Store) Increment(name string) (int64, error) {
+	return s.Add(name, 1)
+}
+
+// Decrement subtracts 1 from the named counter, returning the new value
+func (s *Store) Decrement(name string) (int64, error) {
+	return s.Add(name, -1)
+}
+
+// Reset sets the named counter to 0
+func (s *Store) Reset(name string) error {
+	if err := s.kv.Delete([]byte(counterPrefix + name)); err != nil {
+		delete(s.counts, name)
+		return fmt.Errorf("deleting counter %s: %w", name, err)
+	}
+	cachePut(s.counts, s.maxCached, name, 0)
+	return nil
+}
+
+func windowKey(name string, window time.Duration) string {
+	return fmt.Sprintf("%s%d/%s", windowPrefix, window.Milliseconds(), name)
+}
+
+// getWindowed returns the named counter for window, with its count set to 0
+// if it's from an earlier window.
+func (s *Store) getWindowed(key string, window time.Duration) (windowed, error) {
+	ms := max(window.Milliseconds(), 1)
+	start := s.now().UnixMilli() / ms * ms
+	w, present := s.windows[key]
+	if !present {
+		b, err := s.kv.Get([]byte(key))
+		if err != nil && !errors.Is(err, akcore.ErrNotFound) {
+			return w, err
+		}
+		if err == nil {
+			var n, m int
+			w.start, n = binary.Varint(b)
+			if n > 0 {
+				w.count, m = binary.Varint(b[n:])
+			}
+			if n <= 0 || m <= 0 {
+				return w, fmt.Errorf("invalid value for %q", key)
+			}
+		}
+		cachePut(s.windows, s.maxCached, key, w)
+	}
+	if w.start != start {
+		w = windowed{start: start}
+	}
+	return w, nil
+}
+
+// GetWindowed returns the value of the named counter in the current window,
+// such as time.Minute or 24*time.Hour. Windows are aligned to the Unix epoch,
+// so daily windows start at midnight UTC. Counters with the same name and
+// different windows are independent.
+func (s *Store) GetWindowed(name string, window time.Duration) (int64, error) {
+	w, err := s.getWindowed(windowKey(name, window), window)
+	if err != nil {
+		return 0, fmt.Errorf("getting counter %s: %w", name, err)
+	}
+	return w.count, nil
+}
+
+// AddWindowed adds delta to the named counter in the current window,
+// returning the new value. The counter starts at 0 in each window.
+func (s *Store) AddWindowed(name string, window time.Duration, delta int64) (int64, error) {
+	key := windowKey(name, window)
+	w, err := s.getWindowed(key, window)
+	if err != nil {
+		return 0, fmt.Errorf("getting counter %s: %w", name, err)
+	}
+	w.count += delta
+	b := binary.AppendVarint(nil, w.start)
+	if err := s.kv.Set([]byte(key), binary.AppendVarint(b, w.count)); err != nil {
+		delete(s.windows, key)
+		return 0, fmt.Errorf("setting counter %s: %w", name, err)
+	}
+	cachePut(s.windows, s.maxCached, key, w)
+	return w.count, nil
+}
+
+// IncrementWindowed adds 1 to the named counter in the current window,
+// returning the new value.
+func (s *Store) IncrementWindowed(name string, window time.Duration) (int64, error) {
+	return s.AddWindowed(name, window, 1)
+}
+
+// ResetWindowed sets the named counter in the current window to 0
+func (s *Store) ResetWindowed(name string, window time.Duration) error {
+	key := windowKey(name, window)
+	if err := s.kv.Delete([]byte(key)); err != nil {
+		delete(s.windows, key)
+		return fmt.Errorf("deleting counter %s: %w", name, err)
+	}
+	cachePut(s.windows, s.maxCached, key, windowed{})
+	return nil
+}
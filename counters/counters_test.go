@@ -0,0 +1,66 @@
+//go:build !wasm
+
+package counters_test
+
+import (
+	"testing"
+	"time"
+
+	core "github.com/autonomouskoi/core-tinygo"
+	"github.com/autonomouskoi/core-tinygo/coretest"
+	"github.com/autonomouskoi/core-tinygo/counters"
+)
+
+func TestWindowAlignment(t *testing.T) {
+	coretest.New(t)
+	// 7 hours doesn't divide the time between Go's zero time and the Unix
+	// epoch, so windows aligned to the former start at a different time
+	window := 7 * time.Hour
+	now := time.UnixMilli(0)
+	s := counters.New(nil, []byte("counters/"), counters.Clock(func() time.Time { return now }))
+	for _, tc := range []struct {
+		at   time.Duration
+		want int64
+	}{
+		{0, 1},
+		{window - time.Millisecond, 2},
+		{window, 1},
+		{2*window - time.Millisecond, 2},
+	} {
+		now = time.UnixMilli(0).Add(tc.at)
+		got, err := s.IncrementWindowed("msgs", window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("at %v: got %d, want %d", tc.at, got, tc.want)
+		}
+	}
+}
+
+func TestMaxCached(t *testing.T) {
+	h := coretest.New(t)
+	s := counters.New(core.NewKVStore(), []byte("counters/"), counters.MaxCached(2))
+	for _, name := range []string{"a", "b", "c"} {
+		if _, err := s.Increment(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// changes behind the Store's back are only seen for evicted counters
+	for _, name := range []string{"a", "b", "c"} {
+		h.KVSet([]byte("counters/c/"+name), []byte{10}) // varint 5
+	}
+	reread := 0
+	for _, name := range []string{"a", "b", "c"} {
+		v, err := s.Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v == 5 {
+			reread++
+		}
+	}
+	if reread == 0 {
+		t.Fatal("no counters evicted")
+	}
+}
@@ -0,0 +1,122 @@
+package counters
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/autonomouskoi/akcore"
+	core "github.com/autonomouskoi/core-tinygo"
+)
+
+type bucket struct {
+	tokens  float64
+	updated int64
+}
+
+// A Limiter is a token bucket rate limiter with a bucket for each identity,
+// such as a user ID. Each bucket holds up to a capacity of tokens and gains
+// one every interval. Requests take tokens and are denied when there aren't
+// enough, so an identity can burst up to the capacity and is then limited to
+// the refill rate. A cooldown is a Limiter with a capacity of 1.
+type Limiter struct {
+	store    *Store
+	kv       *core.KVStore
+	capacity float64
+	interval time.Duration
+	buckets  map[string]bucket
+}
+
+// Limiter creates the named Limiter, whose buckets hold capacity tokens and
+// gain one every interval. An identity that hasn't made a request has a full
+// bucket. The name must not contain a zero byte.
+func (s *Store) Limiter(name string, capacity int, interval time.Duration) *Limiter {
+	return &Limiter{
+		store:    s,
+		kv:       s.kv.With(core.KVNamespace([]byte(limiterPrefix + name + "\x00"))),
+		capacity: float64(capacity),
+		interval: interval,
+		buckets:  map[string]bucket{},
+	}
+}
+
+// get returns the identity's bucket, refilled to the current time
+func (l *Limiter) get(identity string) (bucket, error) {
+	now := l.store.now().UnixMilli()
+	b, present := l.buckets[identity]
+	if !present {
+		stored, err := l.kv.Get([]byte(identity))
+		switch {
+		case errors.Is(err, akcore.ErrNotFound):
+			b = bucket{tokens: l.capacity, updated: now}
+		case err != nil:
+			return b, err
+		default:
+			var n int
+			if len(stored) > 8 {
+				b.tokens = math.Float64frombits(binary.BigEndian.Uint64(stored))
+				b.updated, n = binary.Varint(stored[8:])
+			}
+			if n <= 0 {
+				return b, fmt.Errorf("invalid bucket for %q", identity)
+			}
+		}
+		cachePut(l.buckets, l.store.maxCached, identity, b)
+	}
+	if elapsed := now - b.updated; elapsed > 0 && l.interval > 0 {
+		b.tokens = min(l.capacity, b.tokens+float64(elapsed)/float64(l.interval.Milliseconds()))
+	}
+	b.updated = now
+	return b, nil
+}
+
+// AllowN reports whether identity may make a request costing n tokens, taking
+// them if so. A denied request doesn't change the bucket.
+func (l *Limiter) AllowN(identity string, n int) (bool, error) {
+	b, err := l.get(identity)
+	if err != nil {
+		return false, fmt.Errorf("getting bucket: %w", err)
+	}
+	if b.tokens < float64(n) {
+		return false, nil
+	}
+	b.tokens -= float64(n)
+	stored := binary.BigEndian.AppendUint64(nil, math.Float64bits(b.tokens))
+	if err := l.kv.Set([]byte(identity), binary.AppendVarint(stored, b.updated)); err != nil {
+		delete(l.buckets, identity)
+		return false, fmt.Errorf("setting bucket: %w", err)
+	}
+	cachePut(l.buckets, l.store.maxCached, identity, b)
+	return true, nil
+}
+
+// Allow reports whether identity may make a request costing one token, taking
+// it if so.
+func (l *Limiter) Allow(identity string) (bool, error) {
+	return l.AllowN(identity, 1)
+}
+
+// RetryAfter returns how long until identity has n tokens, or 0 if it
+// already does. Requests costing more than the capacity never succeed.
+func (l *Limiter) RetryAfter(identity string, n int) (time.Duration, error) {
+	b, err := l.get(identity)
+	if err != nil {
+		return 0, fmt.Errorf("getting bucket: %w", err)
+	}
+	missing := float64(n) - b.tokens
+	if missing <= 0 {
+		return 0, nil
+	}
+	return time.Duration(math.Ceil(missing * float64(l.interval))), nil
+}
+
+// Reset fills identity's bucket
+func (l *Limiter) Reset(identity string) error {
+	delete(l.buckets, identity)
+	if err := l.kv.Delete([]byte(identity)); err != nil {
+		return fmt.Errorf("deleting bucket: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,6 @@
+// Package export provides the start, recv, and shutdown functions called by
+// the host, backed by the Module registered with core.Register. Import it for
+// its side effects from the plugin's main package:
+//
+//	import _ "github.com/autonomouskoi/core-tinygo/export"
+package export
@@ -0,0 +1,22 @@
+//go:build wasm
+
+package export
+
+import (
+	core "github.com/autonomouskoi/core-tinygo"
+)
+
+//go:export start
+func start() int32 {
+	return core.Start()
+}
+
+//go:export recv
+func recv() int32 {
+	return core.Recv()
+}
+
+//go:export shutdown
+func shutdown() int32 {
+	return core.Shutdown()
+}
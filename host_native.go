@@ -0,0 +1,77 @@
+//go:build !wasm
+
+package core
+
+import (
+	"sync"
+)
+
+// A Host receives the messages a plugin sends when it's built for something
+// other than WASM, e.g. when running plugin code with go test. The coretest
+// package provides an in-memory implementation.
+type Host interface {
+	// Send receives messages sent with Send
+	Send(*BusMessage)
+	// SendReply receives messages sent with SendReply
+	SendReply(*BusMessage)
+	// WaitForReply receives messages sent with WaitForReply and returns the
+	// reply. If there is no reply the returned message should have an Error
+	// with code CommonErrorCode_TIMEOUT.
+	WaitForReply(msg *BusMessage, timeoutMS uint64) *BusMessage
+}
+
+var (
+	hostLock sync.Mutex
+	host     Host
+)
+
+// SetHost sets the Host used by Send, SendReply, and WaitForReply, returning
+// the previously set Host. It is only available when not building for WASM.
+func SetHost(h Host) Host {
+	hostLock.Lock()
+	defer hostLock.Unlock()
+	prev := host
+	host = h
+	return prev
+}
+
+func currentHost() Host {
+	hostLock.Lock()
+	defer hostLock.Unlock()
+	if host == nil {
+		panic("core: no Host set, call SetHost first")
+	}
+	return host
+}
+
+// hostMessage unmarshals b so the Host gets its own copy of the message, as it
+// would when crossing the WASM boundary.
+func hostMessage(b []byte) *BusMessage {
+	msg := &BusMessage{}
+	if err := msg.UnmarshalVT(b); err != nil {
+		panic("core: unmarshalling our own message: " + err.Error())
+	}
+	return msg
+}
+
+func hostSend(b []byte) {
+	currentHost().Send(hostMessage(b))
+}
+
+func hostSendReply(b []byte) {
+	currentHost().SendReply(hostMessage(b))
+}
+
+func hostWaitForReply(b []byte, timeoutMS uint64) []byte {
+	reply := currentHost().WaitForReply(hostMessage(b), timeoutMS)
+	if reply == nil {
+		reply = &BusMessage{
+			Error: &Error{Code: int32(CommonErrorCode_TIMEOUT)},
+		}
+	}
+	rb, err := reply.MarshalVT()
+	if err != nil {
+		panic("core: marshalling reply from Host: " + err.Error())
+	}
+	return rb
+}
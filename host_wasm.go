@@ -0,0 +1,67 @@
+//go:build wasm
+
+package core
+
+import (
+	"github.com/extism/go-pdk"
+)
+
+//go:wasmimport extism:host/user send
+func send(busMessage uint64)
+
+//go:wasmimport extism:host/user send_reply
+func sendReply(busMessage uint64)
+
+//go:wasmimport extism:host/user wait_for_reply
+func waitForReply(busMessage uint64, timeoutMS uint64) uint64
+
+func hostSend(b []byte) {
+	mem := pdk.AllocateBytes(b)
+	send(mem.Offset())
+	mem.Free()
+}
+
+func hostSendReply(b []byte) {
+	mem := pdk.AllocateBytes(b)
+	sendReply(mem.Offset())
+	mem.Free()
+}
+
+func hostWaitForReply(b []byte, timeoutMS uint64) []byte {
+	mem := pdk.AllocateBytes(b)
+	defer mem.Free()
+	replyMem := pdk.FindMemory(waitForReply(mem.Offset(), timeoutMS))
+	defer replyMem.Free()
+	return replyMem.ReadBytes()
+}
+
+// MarshalArg marshals the provided argument for passing as an argument to an
+// invocation of a host function. You probably want to use Send, SendReply, or
+// WaitForReply instead.
+func MarshalArg(msg *BusMessage) (pdk.Memory, error) {
+	b, err := msg.MarshalVT()
+	if err != nil {
+		return pdk.Memory{}, err
+	}
+	mem := pdk.AllocateBytes(b)
+	return mem, nil
+}
+
+// UnmarshalReturn unmarshals a message provided as the return value of the
+// invocation of a host function. You probably want to use Send, SendReply, or
+// WaitForReply instead.
+func UnmarshalReturn(offs uint64) (*BusMessage, error) {
+	mem := pdk.FindMemory(offs)
+	defer mem.Free()
+	msg := &BusMessage{}
+	err := msg.UnmarshalVT(mem.ReadBytes())
+	return msg, err
+}
+
+// UnmarshalInput unmarshals the message provided by the host as the input to
+// an exported function such as recv.
+func UnmarshalInput() (*BusMessage, error) {
+	msg := &BusMessage{}
+	err := msg.UnmarshalVT(pdk.Input())
+	return msg, err
+}
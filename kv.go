@@ -1,103 +1,391 @@
 package core
 
 import (
+	"bytes"
+	"time"
+
 	"github.com/autonomouskoi/akcore"
 )
 
-// KVGet retrieves a value from the KV store. If no value with that key is
+// A KVRetryPolicy decides whether a failed KV request should be retried.
+// attempt is the number of attempts made so far, starting at 1.
+type KVRetryPolicy func(attempt int, err error) bool
+
+// KVRetryTimeouts returns a KVRetryPolicy that retries requests that timed out
+// until maxAttempts attempts have been made.
+func KVRetryTimeouts(maxAttempts int) KVRetryPolicy {
+	return func(attempt int, err error) bool {
+		if attempt >= maxAttempts {
+			return false
+		}
+		busErr, ok := err.(*Error)
+		return ok && busErr.GetCode() == int32(CommonErrorCode_TIMEOUT)
+	}
+}
+
+// A KVOption configures a KVStore
+type KVOption func(*KVStore)
+
+// KVNamespace prefixes every key used with the KVStore with namespace. Keys
+// returned by List have the namespace removed.
+func KVNamespace(namespace []byte) KVOption {
+	return func(s *KVStore) {
+		s.namespace = append(bytes.Clone(s.namespace), namespace...)
+	}
+}
+
+// KVTimeout sets how long the KVStore waits for a reply from the host. The
+// default is 1000 milliseconds.
+func KVTimeout(timeoutMS uint64) KVOption {
+	return func(s *KVStore) {
+		s.timeoutMS = timeoutMS
+	}
+}
+
+// KVRetry sets the retry policy for the KVStore. By default failed requests
+// aren't retried.
+func KVRetry(policy KVRetryPolicy) KVOption {
+	return func(s *KVStore) {
+		s.retry = policy
+	}
+}
+
+// KVClock sets the function the KVStore uses to get the current time, such
+// as when checking whether values have expired. The default is time.Now.
+func KVClock(now func() time.Time) KVOption {
+	return func(s *KVStore) {
+		s.now = now
+	}
+}
+
+// KVStore is a client for the host's KV store
+type KVStore struct {
+	namespace []byte
+	timeoutMS uint64
+	retry     KVRetryPolicy
+	now       func() time.Time
+	compress  int
+	keyring   *KVKeyring
+	cache     *KVCache
+	// watchTopic and watchValues are set by KVWatch
+	watchTopic  string
+	watchValues bool
+	// sweepCursors and txns are shared with KVStores created by With
+	sweepCursors *kvSweepCursors
+	txns         *kvTxnState
+	// recovering is set on the copy RecoverTxns writes with
+	recovering bool
+}
+
+// DefaultKV is the KVStore used by the package-level KV functions, such as
+// KVGet. It has no namespace.
+var DefaultKV = NewKVStore()
+
+// NewKVStore creates a KVStore configured with opts
+func NewKVStore(opts ...KVOption) *KVStore {
+	s := &KVStore{
+		timeoutMS:    1000,
+		now:          time.Now,
+		sweepCursors: &kvSweepCursors{offsets: map[string]int{}},
+		txns:         &kvTxnState{unfinished: map[uint64]struct{}{}},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// With creates a new KVStore with the same configuration as s, modified by
+// opts. Using KVNamespace with With nests the new namespace inside that of s.
+func (s *KVStore) With(opts ...KVOption) *KVStore {
+	ns := *s
+	for _, opt := range opts {
+		opt(&ns)
+	}
+	return &ns
+}
+
+// Namespace returns the namespace prefixed to the KVStore's keys
+func (s *KVStore) Namespace() []byte {
+	return s.namespace
+}
+
+func (s *KVStore) key(key []byte) []byte {
+	if len(s.namespace) == 0 {
+		return key
+	}
+	return append(bytes.Clone(s.namespace), key...)
+}
+
+// do invokes req, retrying according to the retry policy
+func (s *KVStore) do(req func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := req()
+		if err == nil || s.retry == nil || !s.retry(attempt, err) {
+			return err
+		}
+	}
+}
+
+// Get retrieves a value from the KV store. If no value with that key is
 // present, akcore.ErrNotFound will be returned
-func KVGet(key []byte) ([]byte, error) {
+func (s *KVStore) Get(key []byte) ([]byte, error) {
+	stored, err := s.getStored(key)
+	if err != nil {
+		return nil, err
+	}
+	value, _, _, err := s.openValue(s.key(key), stored)
+	if err != nil {
+		return nil, err
+	}
+	return decompressValue(value)
+}
+
+// getStored retrieves a value as it's stored by the host, through the cache
+// if the KVStore has one
+func (s *KVStore) getStored(key []byte) ([]byte, error) {
+	if s.cache != nil {
+		if entry, ok := s.cache.get(s.key(key)); ok {
+			if entry.notFound {
+				return nil, akcore.ErrNotFound
+			}
+			return bytes.Clone(entry.value), nil
+		}
+	}
 	msg := &BusMessage{
 		Type: int32(ExternalMessageType_KV_GET_REQ),
 	}
-	req := &KVGetRequest{Key: key}
+	req := &KVGetRequest{Key: s.key(key)}
 
 	var value []byte
-	var innerErr error
-	err := WaitForReplyWrap(msg, req, func(resp *KVGetResponse, busErr *Error) {
-		if busErr != nil {
-			if busErr.GetCode() == int32(CommonErrorCode_NOT_FOUND) {
-				innerErr = akcore.ErrNotFound
+	err := s.do(func() error {
+		var innerErr error
+		err := WaitForReplyWrap(msg, req, func(resp *KVGetResponse, busErr *Error) {
+			if busErr != nil {
+				if busErr.GetCode() == int32(CommonErrorCode_NOT_FOUND) {
+					innerErr = akcore.ErrNotFound
+					return
+				}
+				innerErr = busErr
 				return
 			}
-			innerErr = busErr
-			return
+			value = resp.GetValue()
+		}, s.timeoutMS)
+		if err != nil {
+			return err
 		}
-		value = resp.GetValue()
-	}, 1000)
+		return innerErr
+	})
+	if s.cache != nil {
+		if err == nil {
+			s.cache.put(s.key(key), value, false)
+		} else if err == akcore.ErrNotFound {
+			s.cache.put(s.key(key), nil, true)
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
-	return value, innerErr
+	return value, nil
 }
 
-// KVGetProto retrieves the value associated with key from the KV store and
+// GetProto retrieves the value associated with key from the KV store and
 // unmarshals it into p.
-func KVGetProto(key []byte, p Unmarshaller) error {
-	value, err := KVGet(key)
+func (s *KVStore) GetProto(key []byte, p Unmarshaller) error {
+	value, err := s.Get(key)
 	if err != nil {
 		return err
 	}
 	return p.UnmarshalVT(value)
 }
 
-// KVSet sets a value in the KV store with the specified key. If there's an
+// Set sets a value in the KV store with the specified key. If there's an
 // existing value with that key it is overwritten
-func KVSet(key, value []byte) error {
+func (s *KVStore) Set(key, value []byte) error {
+	if err := s.set(key, value); err != nil {
+		return err
+	}
+	s.publishChange(KVChangeSet, key, value)
+	return nil
+}
+
+// set compresses and sets value without publishing a change event. Layers
+// that store their own representation of a value, such as TTL envelopes or
+// chunks, use set and publish the logical change themselves.
+func (s *KVStore) set(key, value []byte) error {
+	compressed, err := s.compressValue(value)
+	if err != nil {
+		return err
+	}
+	return s.setStored(key, compressed)
+}
+
+// setStored encrypts value if the KVStore has a keyring and sets it, updating
+// the cache if the KVStore has one
+func (s *KVStore) setStored(key, value []byte) error {
+	if err := s.checkTxns(); err != nil {
+		return err
+	}
+	value, err := s.sealValue(s.key(key), value)
+	if err != nil {
+		return err
+	}
 	msg := &BusMessage{
 		Type: int32(ExternalMessageType_KV_SET_REQ),
 	}
-	req := &KVSetRequest{Key: key, Value: value}
-	var err error
-	err = WaitForReplyWrap(msg, req, func(resp *KVSetResponse, busErr *Error) {
-		err = busErr
-	}, 1000)
+	req := &KVSetRequest{Key: s.key(key), Value: value}
+	err = s.do(func() error {
+		var innerErr error
+		err := WaitForReplyWrap(msg, req, func(resp *KVSetResponse, busErr *Error) {
+			if busErr != nil {
+				innerErr = busErr
+			}
+		}, s.timeoutMS)
+		if err != nil {
+			return err
+		}
+		return innerErr
+	})
+	if s.cache != nil {
+		if err != nil {
+			s.cache.Invalidate(s.key(key))
+		} else {
+			s.cache.put(s.key(key), value, false)
+		}
+	}
 	return err
 }
 
-// KVSetProto marshals p and sets key to that value in the KV store.
-func KVSetProto(key []byte, p Marshaller) error {
+// SetProto marshals p and sets key to that value in the KV store.
+func (s *KVStore) SetProto(key []byte, p Marshaller) error {
 	value, err := p.MarshalVT()
 	if err != nil {
 		return err
 	}
-	return KVSet(key, value)
+	return s.Set(key, value)
 }
 
-// KVList lists keys matching a given prefix or all values if prefix is nil.
+// List lists keys matching a given prefix or all values if prefix is nil.
 // The limit parameter limits the number of matching keys returned. If limit
 // is 0, all matches are returned. The offset parameter can be used to skip
 // matches. If offset is greater than or equal to the total number of matches,
 // no matches are returned. Pagination can be implemented by using the same
 // limit in successive calls and specifying the offset to be the total number
-// of matches retrieved until it reaches the total number of matches.
-func KVList(prefix []byte, limit, offset int) (*KVListResponse, error) {
+// of matches retrieved until it reaches the total number of matches. The
+// returned keys and prefix don't include the KVStore's namespace.
+func (s *KVStore) List(prefix []byte, limit, offset int) (*KVListResponse, error) {
 	msg := &BusMessage{
 		Type: int32(ExternalMessageType_KV_LIST_REQ),
 	}
 	req := &KVListRequest{
-		Prefix: prefix,
+		Prefix: s.key(prefix),
 		Limit:  uint32(limit),
 		Offset: uint32(offset),
 	}
 	var resp *KVListResponse
-	var err error
-	err = WaitForReplyWrap(msg, req, func(gotResp *KVListResponse, busErr *Error) {
-		resp, err = gotResp, busErr
-	}, 1000)
-	return resp, err
+	err := s.do(func() error {
+		var innerErr error
+		err := WaitForReplyWrap(msg, req, func(gotResp *KVListResponse, busErr *Error) {
+			if busErr != nil {
+				innerErr = busErr
+				return
+			}
+			resp = gotResp
+		}, s.timeoutMS)
+		if err != nil {
+			return err
+		}
+		return innerErr
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(s.namespace) > 0 {
+		resp.Prefix = prefix
+		for i, key := range resp.Keys {
+			resp.Keys[i] = bytes.TrimPrefix(key, s.namespace)
+		}
+	}
+	return resp, nil
 }
 
-// KVDelete deletes the value associated with the provided key. If there's no
+// Delete deletes the value associated with the provided key. If there's no
 // value with that key no error is returned.
-func KVDelete(key []byte) error {
+func (s *KVStore) Delete(key []byte) error {
+	if err := s.remove(key); err != nil {
+		return err
+	}
+	s.publishChange(KVChangeDelete, key, nil)
+	return nil
+}
+
+// remove deletes key without publishing a change event. See set.
+func (s *KVStore) remove(key []byte) error {
+	if err := s.checkTxns(); err != nil {
+		return err
+	}
 	msg := &BusMessage{
 		Type: int32(ExternalMessageType_KV_DELETE_REQ),
 	}
-	req := &KVDeleteRequest{Key: key}
-	var err error
-	err = WaitForReplyWrap(msg, req, func(_ *KVDeleteResponse, busErr *Error) {
-		err = busErr
-	}, 1000)
+	req := &KVDeleteRequest{Key: s.key(key)}
+	err := s.do(func() error {
+		var innerErr error
+		err := WaitForReplyWrap(msg, req, func(_ *KVDeleteResponse, busErr *Error) {
+			if busErr != nil {
+				innerErr = busErr
+			}
+		}, s.timeoutMS)
+		if err != nil {
+			return err
+		}
+		return innerErr
+	})
+	if s.cache != nil {
+		if err != nil {
+			s.cache.Invalidate(s.key(key))
+		} else {
+			s.cache.put(s.key(key), nil, true)
+		}
+	}
 	return err
 }
+
+// KVGet retrieves a value from the KV store. If no value with that key is
+// present, akcore.ErrNotFound will be returned
+func KVGet(key []byte) ([]byte, error) {
+	return DefaultKV.Get(key)
+}
+
+// KVGetProto retrieves the value associated with key from the KV store and
+// unmarshals it into p.
+func KVGetProto(key []byte, p Unmarshaller) error {
+	return DefaultKV.GetProto(key, p)
+}
+
+// KVSet sets a value in the KV store with the specified key. If there's an
+// existing value with that key it is overwritten
+func KVSet(key, value []byte) error {
+	return DefaultKV.Set(key, value)
+}
+
+// KVSetProto marshals p and sets key to that value in the KV store.
+func KVSetProto(key []byte, p Marshaller) error {
+	return DefaultKV.SetProto(key, p)
+}
+
+// KVList lists keys matching a given prefix or all values if prefix is nil.
+// The limit parameter limits the number of matching keys returned. If limit
+// is 0, all matches are returned. The offset parameter can be used to skip
+// matches. If offset is greater than or equal to the total number of matches,
+// no matches are returned. Pagination can be implemented by using the same
+// limit in successive calls and specifying the offset to be the total number
+// of matches retrieved until it reaches the total number of matches.
+func KVList(prefix []byte, limit, offset int) (*KVListResponse, error) {
+	return DefaultKV.List(prefix, limit, offset)
+}
+
+// KVDelete deletes the value associated with the provided key. If there's no
+// value with that key no error is returned.
+func KVDelete(key []byte) error {
+	return DefaultKV.Delete(key)
+}
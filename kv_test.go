@@ -0,0 +1,133 @@
+//go:build !wasm
+
+package core_test
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	core "github.com/autonomouskoi/core-tinygo"
+	"github.com/autonomouskoi/core-tinygo/coretest"
+)
+
+// erroringHost fails the first fail KV requests with code, recording the
+// timeout of every KV request
+type erroringHost struct {
+	*coretest.Host
+	fail     int
+	code     core.CommonErrorCode
+	timeouts []uint64
+}
+
+func newErroringHost(t *testing.T) *erroringHost {
+	h := &erroringHost{Host: coretest.New(t)}
+	core.SetHost(h)
+	return h
+}
+
+func (h *erroringHost) WaitForReply(msg *core.BusMessage, timeoutMS uint64) *core.BusMessage {
+	if msg.GetTopic() == "" {
+		h.timeouts = append(h.timeouts, timeoutMS)
+		if len(h.timeouts) <= h.fail {
+			return core.ErrorReply(msg, h.code, "injected failure")
+		}
+	}
+	return h.Host.WaitForReply(msg, timeoutMS)
+}
+
+func TestKVListNamespace(t *testing.T) {
+	h := coretest.New(t)
+	for _, key := range []string{"ns/a", "ns/b", "ns/x/c", "other"} {
+		h.KVSet([]byte(key), nil)
+	}
+	ns := core.NewKVStore(core.KVNamespace([]byte("ns/")))
+	for _, tc := range []struct {
+		name      string
+		kv        *core.KVStore
+		prefix    string
+		want      []string
+		wantTotal uint32
+	}{
+		{"no namespace", core.DefaultKV, "ns/", []string{"ns/a", "ns/b", "ns/x/c"}, 3},
+		{"namespace", ns, "", []string{"a", "b", "x/c"}, 3},
+		{"namespace and prefix", ns, "x/", []string{"x/c"}, 1},
+		{"nested namespace", ns.With(core.KVNamespace([]byte("x/"))), "", []string{"c"}, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := tc.kv.List([]byte(tc.prefix), 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, key := range resp.GetKeys() {
+				got = append(got, string(key))
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("got keys %q, want %q", got, tc.want)
+			}
+			if string(resp.GetPrefix()) != tc.prefix {
+				t.Errorf("got prefix %q, want %q", resp.GetPrefix(), tc.prefix)
+			}
+			if resp.GetTotalMatches() != tc.wantTotal {
+				t.Errorf("got %d total matches, want %d", resp.GetTotalMatches(), tc.wantTotal)
+			}
+		})
+	}
+}
+
+func TestKVTimeout(t *testing.T) {
+	h := newErroringHost(t)
+	for _, kv := range []*core.KVStore{core.DefaultKV, core.NewKVStore(core.KVTimeout(250))} {
+		if err := kv.Set([]byte("k"), nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := kv.Get([]byte("k")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := kv.List(nil, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := kv.Delete([]byte("k")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []uint64{1000, 1000, 1000, 1000, 250, 250, 250, 250}
+	if !slices.Equal(h.timeouts, want) {
+		t.Errorf("got timeouts %v, want %v", h.timeouts, want)
+	}
+}
+
+func TestKVRetryTimeouts(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		retry        core.KVRetryPolicy
+		fail         int
+		code         core.CommonErrorCode
+		wantErr      bool
+		wantRequests int
+	}{
+		{"no policy", nil, 1, core.CommonErrorCode_TIMEOUT, true, 1},
+		{"no failures", core.KVRetryTimeouts(3), 0, core.CommonErrorCode_TIMEOUT, false, 1},
+		{"retried", core.KVRetryTimeouts(3), 2, core.CommonErrorCode_TIMEOUT, false, 3},
+		{"attempts exhausted", core.KVRetryTimeouts(3), 3, core.CommonErrorCode_TIMEOUT, true, 3},
+		{"not a timeout", core.KVRetryTimeouts(3), 1, core.CommonErrorCode_UNKNOWN, true, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newErroringHost(t)
+			h.fail, h.code = tc.fail, tc.code
+			kv := core.NewKVStore(core.KVRetry(tc.retry))
+			err := kv.Set([]byte("k"), []byte("v"))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v", err)
+			}
+			var busErr *core.Error
+			if err != nil && (!errors.As(err, &busErr) || busErr.GetCode() != int32(tc.code)) {
+				t.Errorf("got error %v, want code %v", err, tc.code)
+			}
+			if len(h.timeouts) != tc.wantRequests {
+				t.Errorf("made %d requests, want %d", len(h.timeouts), tc.wantRequests)
+			}
+		})
+	}
+}
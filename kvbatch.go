@@ -0,0 +1,178 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/autonomouskoi/akcore"
+)
+
+// The host has no batch KV requests yet, so the batch operations here are
+// implemented with one request per key. The proposed additions to bus.proto,
+// numbered after the services in svc.MessageType, are:
+//
+//	KV_GET_MANY_REQ       = 21; // KVGetManyRequest { repeated bytes keys = 1; }
+//	KV_GET_MANY_RESP      = 22; // KVGetManyResponse { repeated KVGetResponse values = 1; repeated KVBatchFailure failures = 2; }
+//	KV_SET_MANY_REQ       = 23; // KVSetManyRequest { repeated KVSetRequest entries = 1; }
+//	KV_SET_MANY_RESP      = 24; // KVSetManyResponse { repeated KVBatchFailure failures = 1; }
+//	KV_DELETE_PREFIX_REQ  = 25; // KVDeletePrefixRequest { bytes prefix = 1; }
+//	KV_DELETE_PREFIX_RESP = 26; // KVDeletePrefixResponse { uint32 deleted = 1; repeated KVBatchFailure failures = 2; }
+//
+//	message KVBatchFailure { bytes key = 1; Error error = 2; }
+//
+// Once the host supports them, these functions should try the batch request
+// first and fall back to the per-key implementation if the host replies with
+// an error or times out.
+
+// KVBatchError reports the keys that failed in a batch KV operation. Keys
+// that succeeded are not included.
+type KVBatchError struct {
+	Failed map[string]error
+}
+
+func (e *KVBatchError) add(key []byte, err error) {
+	if e.Failed == nil {
+		e.Failed = map[string]error{}
+	}
+	e.Failed[string(key)] = err
+}
+
+// err returns e if any keys failed, otherwise nil
+func (e *KVBatchError) err() error {
+	if len(e.Failed) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Error implements the built in error interface
+func (e *KVBatchError) Error() string {
+	if len(e.Failed) == 1 {
+		for key, err := range e.Failed {
+			return fmt.Sprintf("key %q: %v", key, err)
+		}
+	}
+	return fmt.Sprintf("%d keys failed", len(e.Failed))
+}
+
+// Unwrap returns the errors for the failed keys, ordered by key
+func (e *KVBatchError) Unwrap() []error {
+	keys := make([]string, 0, len(e.Failed))
+	for key := range e.Failed {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	errs := make([]error, len(keys))
+	for i, key := range keys {
+		errs[i] = e.Failed[key]
+	}
+	return errs
+}
+
+// GetMany retrieves the values for keys. The returned map is keyed by the
+// string form of each key. Keys with no value are omitted from the map
+// without an error. If retrieving any keys fails, the values that were
+// retrieved are returned along with a *KVBatchError.
+func (s *KVStore) GetMany(keys [][]byte) (map[string][]byte, error) {
+	values := make(map[string][]byte, len(keys))
+	batchErr := &KVBatchError{}
+	for _, key := range keys {
+		value, err := s.Get(key)
+		if errors.Is(err, akcore.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			batchErr.add(key, err)
+			continue
+		}
+		values[string(key)] = value
+	}
+	return values, batchErr.err()
+}
+
+// SetMany sets each entry's key to its value. Every entry is attempted; if
+// any fail a *KVBatchError is returned.
+func (s *KVStore) SetMany(entries []KVEntry) error {
+	batchErr := &KVBatchError{}
+	for _, entry := range entries {
+		if err := s.Set(entry.Key, entry.Value); err != nil {
+			batchErr.add(entry.Key, err)
+		}
+	}
+	return batchErr.err()
+}
+
+// DeletePrefix deletes every key matching prefix, returning the number of
+// keys deleted. If deleting any keys fails, deletion continues with the
+// remaining keys and a *KVBatchError is returned. An error listing keys is
+// returned directly.
+func (s *KVStore) DeletePrefix(prefix []byte) (int, error) {
+	return s.deletePrefix(prefix, s.Delete)
+}
+
+// deletePrefix implements DeletePrefix, deleting each key with del
+func (s *KVStore) deletePrefix(prefix []byte, del func([]byte) error) (int, error) {
+	batchErr := &KVBatchError{}
+	deleted := 0
+	// offset is the number of keys left before the next key to try, such as
+	// those that failed to delete, and kept is the last of them. last is the
+	// last key tried.
+	var kept, last []byte
+	offset := 0
+	for {
+		start, limit := offset, DefaultKVPageSize
+		if offset > 0 {
+			// overlap by one key to check the keys left are unchanged
+			start, limit = offset-1, limit+1
+		}
+		resp, err := s.List(prefix, limit, start)
+		if err != nil {
+			return deleted, fmt.Errorf("listing: %w", err)
+		}
+		keys := resp.GetKeys()
+		if offset > 0 {
+			if len(keys) == 0 || !bytes.Equal(keys[0], kept) {
+				// keys left were deleted after all or keys were added, so
+				// re-list from the start, skipping keys already tried
+				offset, kept = 0, nil
+				continue
+			}
+			keys = keys[1:]
+		}
+		if len(keys) == 0 {
+			return deleted, batchErr.err()
+		}
+		for _, key := range keys {
+			if last != nil && bytes.Compare(key, last) <= 0 {
+				offset, kept = offset+1, key
+				continue
+			}
+			last = key
+			if err := del(key); err != nil {
+				batchErr.add(key, err)
+				offset, kept = offset+1, key
+				continue
+			}
+			deleted++
+		}
+	}
+}
+
+// KVGetMany retrieves the values for keys from DefaultKV. See
+// KVStore.GetMany.
+func KVGetMany(keys [][]byte) (map[string][]byte, error) {
+	return DefaultKV.GetMany(keys)
+}
+
+// KVSetMany sets multiple values in DefaultKV. See KVStore.SetMany.
+func KVSetMany(entries []KVEntry) error {
+	return DefaultKV.SetMany(entries)
+}
+
+// KVDeletePrefix deletes every key matching prefix from DefaultKV. See
+// KVStore.DeletePrefix.
+func KVDeletePrefix(prefix []byte) (int, error) {
+	return DefaultKV.DeletePrefix(prefix)
+}
@@ -0,0 +1,136 @@
+//go:build !wasm
+
+package core_test
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+
+	core "github.com/autonomouskoi/core-tinygo"
+	"github.com/autonomouskoi/core-tinygo/coretest"
+)
+
+// keyFailingHost fails KV get, set and delete requests for the keys in fail.
+// If applyFailed is true, a failed set or delete is made anyway, as if only
+// the reply was lost.
+type keyFailingHost struct {
+	*coretest.Host
+	fail        map[string]bool
+	applyFailed bool
+}
+
+func newKeyFailingHost(t *testing.T, keys ...string) *keyFailingHost {
+	h := &keyFailingHost{Host: coretest.New(t), fail: map[string]bool{}}
+	for _, key := range keys {
+		h.fail[key] = true
+	}
+	core.SetHost(h)
+	return h
+}
+
+func (h *keyFailingHost) WaitForReply(msg *core.BusMessage, timeoutMS uint64) *core.BusMessage {
+	if msg.GetTopic() != "" {
+		return h.Host.WaitForReply(msg, timeoutMS)
+	}
+	var key []byte
+	switch core.ExternalMessageType(msg.GetType()) {
+	case core.ExternalMessageType_KV_GET_REQ:
+		req := &core.KVGetRequest{}
+		req.UnmarshalVT(msg.GetMessage())
+		key = req.GetKey()
+	case core.ExternalMessageType_KV_SET_REQ:
+		req := &core.KVSetRequest{}
+		req.UnmarshalVT(msg.GetMessage())
+		key = req.GetKey()
+	case core.ExternalMessageType_KV_DELETE_REQ:
+		req := &core.KVDeleteRequest{}
+		req.UnmarshalVT(msg.GetMessage())
+		key = req.GetKey()
+	}
+	if !h.fail[string(key)] {
+		return h.Host.WaitForReply(msg, timeoutMS)
+	}
+	if h.applyFailed {
+		h.Host.WaitForReply(msg, timeoutMS)
+	}
+	return core.ErrorReply(msg, core.CommonErrorCode_UNKNOWN, "injected failure")
+}
+
+func TestKVGetManyPartialFailure(t *testing.T) {
+	h := newKeyFailingHost(t, "b")
+	h.KVSet([]byte("a"), []byte("1"))
+	h.KVSet([]byte("b"), []byte("2"))
+	values, err := core.KVGetMany([][]byte{[]byte("a"), []byte("b"), []byte("missing")})
+	var batchErr *core.KVBatchError
+	if !errors.As(err, &batchErr) || len(batchErr.Failed) != 1 || batchErr.Failed["b"] == nil {
+		t.Fatalf("got %v, want b failed", err)
+	}
+	if len(values) != 1 || string(values["a"]) != "1" {
+		t.Errorf("got values %q, want a", values)
+	}
+}
+
+func TestKVSetManyPartialFailure(t *testing.T) {
+	h := newKeyFailingHost(t, "b")
+	err := core.KVSetMany([]core.KVEntry{
+		{Key: []byte("a"), Value: []byte("1")},
+		{Key: []byte("b"), Value: []byte("2")},
+		{Key: []byte("c"), Value: []byte("3")},
+	})
+	var batchErr *core.KVBatchError
+	if !errors.As(err, &batchErr) || len(batchErr.Failed) != 1 || batchErr.Failed["b"] == nil {
+		t.Fatalf("got %v, want b failed", err)
+	}
+	var got []string
+	for _, key := range h.KVKeys() {
+		got = append(got, string(key))
+	}
+	if want := []string{"a", "c"}; !slices.Equal(got, want) {
+		t.Errorf("got keys %q, want %q", got, want)
+	}
+}
+
+func TestKVDeletePrefixPartialFailure(t *testing.T) {
+	// more keys than a page, with failures on the first page
+	keys := make([]string, core.DefaultKVPageSize+50)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("k/%03d", i)
+	}
+	for _, tc := range []struct {
+		name        string
+		applyFailed bool
+		wantDeleted int
+		wantLeft    []string
+	}{
+		{"keys left", false, len(keys) - 2, []string{"k/010", "k/020"}},
+		{"deleted after all", true, len(keys) - 2, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newKeyFailingHost(t, "k/010", "k/020")
+			h.applyFailed = tc.applyFailed
+			for _, key := range keys {
+				h.KVSet([]byte(key), nil)
+			}
+			h.KVSet([]byte("other"), nil)
+			deleted, err := core.KVDeletePrefix([]byte("k/"))
+			var batchErr *core.KVBatchError
+			if !errors.As(err, &batchErr) || len(batchErr.Failed) != 2 {
+				t.Fatalf("got %v, want 2 keys failed", err)
+			}
+			if deleted != tc.wantDeleted {
+				t.Errorf("deleted %d, want %d", deleted, tc.wantDeleted)
+			}
+			var left []string
+			for _, key := range h.KVKeys() {
+				if key := string(key); key != "other" {
+					left = append(left, key)
+				}
+			}
+			if !slices.Equal(left, tc.wantLeft) {
+				t.Errorf("got keys left %q, want %q", left, tc.wantLeft)
+			}
+		})
+	}
+}
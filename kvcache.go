@@ -0,0 +1,139 @@
+package core
+
+import (
+	"bytes"
+	"container/list"
+)
+
+// KVCacheStats are counters describing the effectiveness of a KVCache
+type KVCacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int
+	Bytes     int
+}
+
+type kvCacheEntry struct {
+	key   string
+	value []byte
+	// notFound marks a key cached as having no value
+	notFound bool
+}
+
+// A KVCache is a least-recently-used cache of KV values, bounded by the number
+// of entries and the total size of the keys and values. Attach it to a
+// KVStore with KVCached. A KVCache can be shared by KVStores; entries are
+// keyed by the full key, including the namespace.
+type KVCache struct {
+	maxEntries int
+	maxBytes   int
+	bytes      int
+	entries    map[string]*list.Element
+	lru        *list.List
+	stats      KVCacheStats
+}
+
+// NewKVCache creates a KVCache holding at most maxEntries entries totalling at
+// most maxBytes bytes. A limit of 0 means no limit.
+func NewKVCache(maxEntries, maxBytes int) *KVCache {
+	return &KVCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		entries:    map[string]*list.Element{},
+		lru:        list.New(),
+	}
+}
+
+// KVCached makes the KVStore read values through cache. Values and missing
+// keys are cached when read, and the cache is updated when values are set or
+// deleted through the KVStore. Values are cached as they're stored by the
+// host, still compressed and encrypted, so a KVStore sharing the cache must
+// be able to decrypt them just as if it read them from the host. Changes made
+// by other plugins or through KVStores without the cache aren't seen until
+// the entry is invalidated or evicted.
+func KVCached(cache *KVCache) KVOption {
+	return func(s *KVStore) {
+		s.cache = cache
+	}
+}
+
+func (e *kvCacheEntry) size() int {
+	return len(e.key) + len(e.value)
+}
+
+// get returns the entry for key and whether there is one
+func (c *KVCache) get(key []byte) (*kvCacheEntry, bool) {
+	elem, present := c.entries[string(key)]
+	if !present {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*kvCacheEntry), true
+}
+
+// put caches value for key, or caches key as not found if notFound is true
+func (c *KVCache) put(key, value []byte, notFound bool) {
+	c.Invalidate(key)
+	entry := &kvCacheEntry{
+		key:      string(key),
+		value:    bytes.Clone(value),
+		notFound: notFound,
+	}
+	if c.maxBytes > 0 && entry.size() > c.maxBytes {
+		return
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.bytes += entry.size()
+	for (c.maxEntries > 0 && c.lru.Len() > c.maxEntries) || (c.maxBytes > 0 && c.bytes > c.maxBytes) {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *KVCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*kvCacheEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.size()
+}
+
+// Invalidate removes the entry for the full key, including any namespace, so
+// the next read goes to the host.
+func (c *KVCache) Invalidate(key []byte) {
+	if elem, present := c.entries[string(key)]; present {
+		c.remove(elem)
+	}
+}
+
+// InvalidatePrefix removes the entries for full keys starting with prefix
+func (c *KVCache) InvalidatePrefix(prefix []byte) {
+	for key, elem := range c.entries {
+		if bytes.HasPrefix([]byte(key), prefix) {
+			c.remove(elem)
+		}
+	}
+}
+
+// Clear removes every entry. The counters are retained.
+func (c *KVCache) Clear() {
+	c.entries = map[string]*list.Element{}
+	c.lru.Init()
+	c.bytes = 0
+}
+
+// Stats returns the cache's counters and current size
+func (c *KVCache) Stats() KVCacheStats {
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	stats.Bytes = c.bytes
+	return stats
+}
+
+// Invalidate removes key from the KVStore's cache, if it has one
+func (s *KVStore) Invalidate(key []byte) {
+	if s.cache != nil {
+		s.cache.Invalidate(s.key(key))
+	}
+}
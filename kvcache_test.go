@@ -0,0 +1,84 @@
+//go:build !wasm
+
+package core_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/autonomouskoi/akcore"
+	core "github.com/autonomouskoi/core-tinygo"
+	"github.com/autonomouskoi/core-tinygo/coretest"
+)
+
+func TestKVCacheReadThrough(t *testing.T) {
+	h := coretest.New(t)
+	cache := core.NewKVCache(0, 0)
+	kv := core.NewKVStore(core.KVCached(cache))
+	if _, err := kv.Get([]byte("k")); !errors.Is(err, akcore.ErrNotFound) {
+		t.Fatalf("got %v, want ErrNotFound", err)
+	}
+	if err := kv.Set([]byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	// a change behind the cache's back isn't seen until invalidated
+	h.KVSet([]byte("k"), []byte("other"))
+	for _, tc := range []struct {
+		invalidate bool
+		want       string
+	}{
+		{false, "v"},
+		{true, "other"},
+	} {
+		if tc.invalidate {
+			kv.Invalidate([]byte("k"))
+		}
+		got, err := kv.Get([]byte("k"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tc.want {
+			t.Errorf("invalidate %v: got %q, want %q", tc.invalidate, got, tc.want)
+		}
+	}
+}
+
+func TestKVCacheEviction(t *testing.T) {
+	coretest.New(t)
+	cache := core.NewKVCache(2, 0)
+	kv := core.NewKVStore(core.KVCached(cache))
+	for _, key := range []string{"a", "b", "c"} {
+		if err := kv.Set([]byte(key), []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := cache.Stats()
+	if stats.Entries != 2 || stats.Evictions != 1 {
+		t.Fatalf("got %+v, want 2 entries and 1 eviction", stats)
+	}
+}
+
+func TestKVCacheSharedAcrossKeyrings(t *testing.T) {
+	coretest.New(t)
+	keyring, err := core.NewKVKeyring(1, bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := core.NewKVCache(0, 0)
+	encrypted := core.NewKVStore(core.KVCached(cache), core.KVEncrypt(keyring))
+	plain := core.NewKVStore(core.KVCached(cache))
+	if err := encrypted.Set([]byte("secret"), []byte("token")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := plain.Get([]byte("secret")); !errors.Is(err, core.ErrKVDecrypt) {
+		t.Fatalf("got %q, %v, want ErrKVDecrypt", got, err)
+	}
+	got, err := encrypted.Get([]byte("secret"))
+	if err != nil || string(got) != "token" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	if stats := cache.Stats(); stats.Hits != 2 {
+		t.Errorf("got %d hits, want 2", stats.Hits)
+	}
+}
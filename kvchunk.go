@@ -0,0 +1,251 @@
+package core
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/autonomouskoi/akcore"
+)
+
+// DefaultKVChunkSize is the chunk size used by SetChunked when chunkSize is 0
+const DefaultKVChunkSize = 32 * 1024
+
+// ErrKVChunkCorrupt is returned by GetChunked when a chunked value's manifest
+// is invalid or the value is missing chunks or doesn't match the manifest.
+var ErrKVChunkCorrupt = errors.New("chunked KV value corrupt")
+
+// kvChunkPrefix starts the keys of every chunk. A chunk's key is the escaped
+// key of its value, the generation of the value, and the chunk's index.
+const kvChunkPrefix = "\x00chunk/"
+
+// kvChunkManifest describes a chunked value. It's stored with the value's key.
+type kvChunkManifest struct {
+	size       uint64
+	chunks     uint64
+	generation uint64
+	checksum   [sha256.Size]byte
+}
+
+func (m *kvChunkManifest) encode() []byte {
+	b := kvEnvelopeHeader(kvEnvelopeChunked)
+	b = binary.AppendUvarint(b, m.size)
+	b = binary.AppendUvarint(b, m.chunks)
+	b = binary.BigEndian.AppendUint64(b, m.generation)
+	return append(b, m.checksum[:]...)
+}
+
+// decodeKVChunkManifest decodes the manifest in stored, returning nil if
+// stored isn't a manifest.
+func decodeKVChunkManifest(stored []byte) (*kvChunkManifest, error) {
+	b, ok := cutKVEnvelope(stored, kvEnvelopeChunked)
+	if !ok {
+		return nil, nil
+	}
+	m := &kvChunkManifest{}
+	var n int
+	if m.size, n = binary.Uvarint(b); n <= 0 {
+		return nil, errors.New("invalid manifest size")
+	}
+	b = b[n:]
+	if m.chunks, n = binary.Uvarint(b); n <= 0 {
+		return nil, errors.New("invalid manifest chunk count")
+	}
+	b = b[n:]
+	if len(b) != 8+sha256.Size {
+		return nil, errors.New("invalid manifest length")
+	}
+	m.generation = binary.BigEndian.Uint64(b)
+	copy(m.checksum[:], b[8:])
+	return m, nil
+}
+
+func kvChunksPrefix(key []byte) []byte {
+	return appendKeyPart([]byte(kvChunkPrefix), key)
+}
+
+func kvChunkKey(key []byte, generation, index uint64) []byte {
+	b := binary.BigEndian.AppendUint64(kvChunksPrefix(key), generation)
+	return binary.BigEndian.AppendUint64(b, index)
+}
+
+// SetChunked stores value with key, split into chunks of at most chunkSize
+// bytes, or DefaultKVChunkSize if chunkSize is 0, so that no single request to
+// the host carries more than one chunk. The chunks are written first and the
+// manifest describing them last, so a partially written value is never
+// visible; the previous value is readable until the manifest is replaced.
+// Values no larger than chunkSize are stored as they are.
+func (s *KVStore) SetChunked(key, value []byte, chunkSize int) error {
+	if chunkSize <= 0 {
+		chunkSize = DefaultKVChunkSize
+	}
+	old, err := s.chunkManifest(key)
+	if err != nil {
+		return err
+	}
+	if len(value) <= chunkSize {
+		if err := s.set(key, value); err != nil {
+			return err
+		}
+		s.publishChange(KVChangeSet, key, value)
+		return s.deleteChunks(key, old)
+	}
+	m := &kvChunkManifest{
+		size:     uint64(len(value)),
+		checksum: sha256.Sum256(value),
+	}
+	var gen [8]byte
+	if _, err := rand.Read(gen[:]); err != nil {
+		return fmt.Errorf("generating generation: %w", err)
+	}
+	m.generation = binary.BigEndian.Uint64(gen[:])
+	for offset := 0; offset < len(value); offset += chunkSize {
+		chunk := value[offset:min(offset+chunkSize, len(value))]
+		if err := s.set(kvChunkKey(key, m.generation, m.chunks), chunk); err != nil {
+			return fmt.Errorf("setting chunk %d: %w", m.chunks, err)
+		}
+		m.chunks++
+	}
+	if err := s.set(key, m.encode()); err != nil {
+		return fmt.Errorf("setting manifest: %w", err)
+	}
+	s.publishChange(KVChangeSet, key, value)
+	return s.deleteChunks(key, old)
+}
+
+// chunkManifest gets the manifest stored with key, or nil if there isn't one
+func (s *KVStore) chunkManifest(key []byte) (*kvChunkManifest, error) {
+	stored, err := s.Get(key)
+	if errors.Is(err, akcore.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getting manifest: %w", err)
+	}
+	return decodeKVChunkManifest(stored)
+}
+
+// deleteChunks deletes the chunks described by m, if it's not nil
+func (s *KVStore) deleteChunks(key []byte, m *kvChunkManifest) error {
+	if m == nil {
+		return nil
+	}
+	for i := uint64(0); i < m.chunks; i++ {
+		if err := s.remove(kvChunkKey(key, m.generation, i)); err != nil {
+			return fmt.Errorf("deleting chunk %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// GetChunked retrieves a value stored with SetChunked, reassembling its
+// chunks. If chunks are missing or the reassembled value doesn't match its
+// checksum, ErrKVChunkCorrupt is returned. Values not stored in chunks are
+// returned as they are.
+func (s *KVStore) GetChunked(key []byte) ([]byte, error) {
+	stored, err := s.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	m, err := decodeKVChunkManifest(stored)
+	if err != nil {
+		return nil, fmt.Errorf("%w: decoding manifest: %w", ErrKVChunkCorrupt, err)
+	}
+	if m == nil {
+		return stored, nil
+	}
+	// the manifest's size isn't trusted for allocating, the value grows as
+	// chunks are read
+	var value []byte
+	for i := uint64(0); i < m.chunks; i++ {
+		chunk, err := s.Get(kvChunkKey(key, m.generation, i))
+		if errors.Is(err, akcore.ErrNotFound) {
+			return nil, fmt.Errorf("%w: missing chunk %d", ErrKVChunkCorrupt, i)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("getting chunk %d: %w", i, err)
+		}
+		value = append(value, chunk...)
+		if uint64(len(value)) > m.size {
+			return nil, fmt.Errorf("%w: larger than manifest size", ErrKVChunkCorrupt)
+		}
+	}
+	if uint64(len(value)) != m.size || sha256.Sum256(value) != m.checksum {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrKVChunkCorrupt)
+	}
+	return value, nil
+}
+
+// DeleteChunked deletes a value stored with SetChunked and its chunks. The
+// manifest is deleted first so the value disappears at once.
+func (s *KVStore) DeleteChunked(key []byte) error {
+	m, err := s.chunkManifest(key)
+	if err != nil {
+		return err
+	}
+	if err := s.Delete(key); err != nil {
+		return err
+	}
+	return s.deleteChunks(key, m)
+}
+
+// CleanupChunks deletes orphaned chunks, those not belonging to the current
+// manifest of their value, such as chunks left by a SetChunked that didn't
+// complete. It returns the number of chunks deleted.
+func (s *KVStore) CleanupChunks() (int, error) {
+	var orphans [][]byte
+	manifests := map[string]*kvChunkManifest{}
+	for chunkKey, err := range s.Keys([]byte(kvChunkPrefix), 0) {
+		if err != nil {
+			return 0, err
+		}
+		key, rest, ok := cutKeyPart(chunkKey[len(kvChunkPrefix):])
+		if !ok || len(rest) != 16 {
+			orphans = append(orphans, chunkKey)
+			continue
+		}
+		m, present := manifests[string(key)]
+		if !present {
+			if m, err = s.chunkManifest(key); err != nil {
+				return 0, fmt.Errorf("%q: %w", key, err)
+			}
+			manifests[string(key)] = m
+		}
+		generation := binary.BigEndian.Uint64(rest)
+		index := binary.BigEndian.Uint64(rest[8:])
+		if m == nil || m.generation != generation || index >= m.chunks {
+			orphans = append(orphans, chunkKey)
+		}
+	}
+	for i, chunkKey := range orphans {
+		if err := s.remove(chunkKey); err != nil {
+			return i, fmt.Errorf("deleting %q: %w", chunkKey, err)
+		}
+	}
+	return len(orphans), nil
+}
+
+// KVSetChunked stores a value in DefaultKV in chunks. See KVStore.SetChunked.
+func KVSetChunked(key, value []byte, chunkSize int) error {
+	return DefaultKV.SetChunked(key, value, chunkSize)
+}
+
+// KVGetChunked retrieves a value stored with KVSetChunked from DefaultKV. See
+// KVStore.GetChunked.
+func KVGetChunked(key []byte) ([]byte, error) {
+	return DefaultKV.GetChunked(key)
+}
+
+// KVDeleteChunked deletes a value stored with KVSetChunked from DefaultKV. See
+// KVStore.DeleteChunked.
+func KVDeleteChunked(key []byte) error {
+	return DefaultKV.DeleteChunked(key)
+}
+
+// KVCleanupChunks deletes orphaned chunks from DefaultKV. See
+// KVStore.CleanupChunks.
+func KVCleanupChunks() (int, error) {
+	return DefaultKV.CleanupChunks()
+}
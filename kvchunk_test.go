@@ -0,0 +1,142 @@
+//go:build !wasm
+
+package core_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"testing"
+
+	core "github.com/autonomouskoi/core-tinygo"
+	"github.com/autonomouskoi/core-tinygo/coretest"
+)
+
+// failingHost fails the failSet'th KV set request, as if the plugin stopped
+// before it was made, and the failCount-1 sets after it
+type failingHost struct {
+	*coretest.Host
+	failSet   int
+	failCount int
+	sets      int
+}
+
+func newFailingHost(t *testing.T, failSet int) *failingHost {
+	h := &failingHost{Host: coretest.New(t), failSet: failSet}
+	core.SetHost(h)
+	return h
+}
+
+func (h *failingHost) WaitForReply(msg *core.BusMessage, timeoutMS uint64) *core.BusMessage {
+	if msg.GetTopic() == "" && msg.GetType() == int32(core.ExternalMessageType_KV_SET_REQ) {
+		h.sets++
+		if h.failSet > 0 && h.sets >= h.failSet && h.sets < h.failSet+max(h.failCount, 1) {
+			return core.ErrorReply(msg, core.CommonErrorCode_UNKNOWN, "injected failure")
+		}
+	}
+	return h.Host.WaitForReply(msg, timeoutMS)
+}
+
+func TestKVChunked(t *testing.T) {
+	h := coretest.New(t)
+	key := []byte("k")
+	for _, tc := range []struct {
+		name     string
+		size     int
+		wantKeys int
+	}{
+		{"inline", 3, 1},
+		{"chunked", 10, 4},
+		{"fewer chunks", 6, 3},
+		{"inline again", 4, 1},
+	} {
+		value := bytes.Repeat([]byte(tc.name[:1]), tc.size)
+		if err := core.KVSetChunked(key, value, 4); err != nil {
+			t.Fatal(err)
+		}
+		got, err := core.KVGetChunked(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, value) {
+			t.Errorf("%s: got %q, want %q", tc.name, got, value)
+		}
+		// the manifest and the current chunks, with the old chunks deleted
+		if keys := h.KVKeys(); len(keys) != tc.wantKeys {
+			t.Errorf("%s: got %d keys, want %d: %q", tc.name, len(keys), tc.wantKeys, keys)
+		}
+	}
+	if err := core.KVDeleteChunked(key); err != nil {
+		t.Fatal(err)
+	}
+	if keys := h.KVKeys(); len(keys) != 0 {
+		t.Errorf("keys left after delete: %q", keys)
+	}
+}
+
+func TestKVChunkedCorrupt(t *testing.T) {
+	// the manifest is the envelope header, the size, the chunk count, the
+	// generation and the checksum
+	setSize := func(size uint64) func(h *coretest.Host) {
+		return func(h *coretest.Host) {
+			m, _ := h.KVGet([]byte("k"))
+			b := binary.AppendUvarint(slices.Clone(m[:4]), size)
+			h.KVSet([]byte("k"), append(b, m[5:]...))
+		}
+	}
+	for _, tc := range []struct {
+		name    string
+		corrupt func(h *coretest.Host)
+	}{
+		{"chunk altered", func(h *coretest.Host) {
+			for _, key := range h.KVKeys() {
+				if bytes.HasPrefix(key, []byte("\x00chunk/")) {
+					h.KVSet(key, []byte("yyyy"))
+					break
+				}
+			}
+		}},
+		{"size too large", setSize(1 << 62)},
+		{"size too small", setSize(1)},
+		{"manifest truncated", func(h *coretest.Host) {
+			m, _ := h.KVGet([]byte("k"))
+			h.KVSet([]byte("k"), m[:len(m)-1])
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := coretest.New(t)
+			if err := core.KVSetChunked([]byte("k"), bytes.Repeat([]byte("x"), 10), 4); err != nil {
+				t.Fatal(err)
+			}
+			tc.corrupt(h)
+			if _, err := core.KVGetChunked([]byte("k")); !errors.Is(err, core.ErrKVChunkCorrupt) {
+				t.Fatalf("got %v, want ErrKVChunkCorrupt", err)
+			}
+		})
+	}
+}
+
+func TestKVCleanupChunks(t *testing.T) {
+	h := newFailingHost(t, 0)
+	old := bytes.Repeat([]byte("o"), 10)
+	if err := core.KVSetChunked([]byte("k"), old, 4); err != nil {
+		t.Fatal(err)
+	}
+	// fail setting the new manifest after its 3 chunks are set
+	h.failSet = h.sets + 4
+	if err := core.KVSetChunked([]byte("k"), bytes.Repeat([]byte("n"), 10), 4); err == nil {
+		t.Fatal("set didn't fail")
+	}
+	got, err := core.KVGetChunked([]byte("k"))
+	if err != nil || !bytes.Equal(got, old) {
+		t.Fatalf("got %q, %v, want the old value", got, err)
+	}
+	deleted, err := core.KVCleanupChunks()
+	if err != nil || deleted != 3 {
+		t.Fatalf("got %d, %v, want 3 orphans deleted", deleted, err)
+	}
+	if keys := h.KVKeys(); len(keys) != 4 {
+		t.Errorf("got %d keys, want the manifest and 3 chunks", len(keys))
+	}
+}
@@ -0,0 +1,59 @@
+package core
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+// KVCompress makes the KVStore compress values larger than threshold bytes
+// with DEFLATE when setting them. Values are only stored compressed if that
+// makes them smaller. Compressed values are tagged with a header so every
+// KVStore, including DefaultKV, decompresses them when getting them, whether
+// or not it has this option. Values stored before this option was used are
+// read as they are.
+func KVCompress(threshold int) KVOption {
+	return func(s *KVStore) {
+		s.compress = threshold
+	}
+}
+
+// compressValue returns value compressed and tagged if it's larger than the
+// KVStore's threshold and compression makes it smaller, otherwise value.
+func (s *KVStore) compressValue(value []byte) ([]byte, error) {
+	if s.compress <= 0 || len(value) <= s.compress {
+		return value, nil
+	}
+	buf := bytes.NewBuffer(kvEnvelopeHeader(kvEnvelopeCompressed))
+	w, err := flate.NewWriter(buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(value); err != nil {
+		return nil, fmt.Errorf("compressing: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("compressing: %w", err)
+	}
+	if buf.Len() >= len(value) {
+		return value, nil
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressValue returns stored decompressed if it's tagged as compressed,
+// otherwise stored.
+func decompressValue(stored []byte) ([]byte, error) {
+	b, ok := cutKVEnvelope(stored, kvEnvelopeCompressed)
+	if !ok {
+		return stored, nil
+	}
+	r := flate.NewReader(bytes.NewReader(b))
+	defer r.Close()
+	value, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing: %w", err)
+	}
+	return value, nil
+}
@@ -0,0 +1,64 @@
+//go:build !wasm
+
+package core_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	core "github.com/autonomouskoi/core-tinygo"
+	"github.com/autonomouskoi/core-tinygo/coretest"
+)
+
+func TestKVCompress(t *testing.T) {
+	random := make([]byte, 100)
+	rand.Read(random)
+	for _, tc := range []struct {
+		name           string
+		value          []byte
+		wantCompressed bool
+	}{
+		{"above threshold", bytes.Repeat([]byte("abc"), 100), true},
+		{"at threshold", bytes.Repeat([]byte("a"), 10), false},
+		{"not smaller", random, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := coretest.New(t)
+			kv := core.NewKVStore(core.KVCompress(10))
+			if err := kv.Set([]byte("k"), tc.value); err != nil {
+				t.Fatal(err)
+			}
+			stored, _ := h.KVGet([]byte("k"))
+			compressed := bytes.HasPrefix(stored, []byte("\x00akZ"))
+			if compressed != tc.wantCompressed {
+				t.Errorf("got compressed %t, want %t", compressed, tc.wantCompressed)
+			}
+			if compressed && len(stored) >= len(tc.value) {
+				t.Errorf("stored %d bytes for a %d byte value", len(stored), len(tc.value))
+			}
+			if !compressed && !bytes.Equal(stored, tc.value) {
+				t.Errorf("stored %q, want the value as it is", stored)
+			}
+			// stores without the option decompress too
+			for _, reader := range []*core.KVStore{kv, core.DefaultKV} {
+				if got, err := reader.Get([]byte("k")); err != nil || !bytes.Equal(got, tc.value) {
+					t.Errorf("got %q, %v, want the value", got, err)
+				}
+			}
+		})
+	}
+}
+
+func TestKVCompressLegacy(t *testing.T) {
+	h := coretest.New(t)
+	value := bytes.Repeat([]byte("abc"), 100)
+	// stored before compression was enabled
+	h.KVSet([]byte("k"), value)
+	kv := core.NewKVStore(core.KVCompress(10))
+	for _, reader := range []*core.KVStore{kv, core.DefaultKV} {
+		if got, err := reader.Get([]byte("k")); err != nil || !bytes.Equal(got, value) {
+			t.Errorf("got %q, %v, want the value", got, err)
+		}
+	}
+}
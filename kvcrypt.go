@@ -0,0 +1,187 @@
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/autonomouskoi/akcore"
+)
+
+// ErrKVDecrypt is returned, wrapped, when an encrypted KV value can't be
+// decrypted, such as when its key isn't in the KVStore's keyring or the value
+// has been tampered with.
+var ErrKVDecrypt = errors.New("decrypting KV value")
+
+// A KVKeyring holds the AES keys used to encrypt and decrypt KV values. Each
+// key has an ID that's stored with the values it encrypts. New values are
+// encrypted with the current key; older keys are kept to decrypt existing
+// values until they're re-encrypted.
+type KVKeyring struct {
+	current uint32
+	aeads   map[uint32]cipher.AEAD
+}
+
+// NewKVKeyring creates a KVKeyring with key as the current key. The key must
+// be 16, 24, or 32 bytes for AES-128, AES-192, or AES-256.
+func NewKVKeyring(id uint32, key []byte) (*KVKeyring, error) {
+	kr := &KVKeyring{aeads: map[uint32]cipher.AEAD{}}
+	if err := kr.Add(id, key); err != nil {
+		return nil, err
+	}
+	kr.current = id
+	return kr, nil
+}
+
+// Add adds a key that can decrypt values without making it the current key.
+func (kr *KVKeyring) Add(id uint32, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("creating cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return fmt.Errorf("creating GCM: %w", err)
+	}
+	kr.aeads[id] = aead
+	return nil
+}
+
+// Rotate adds key and makes it the current key. Existing values can be
+// re-encrypted with it using KVStore.Reencrypt.
+func (kr *KVKeyring) Rotate(id uint32, key []byte) error {
+	if err := kr.Add(id, key); err != nil {
+		return err
+	}
+	kr.current = id
+	return nil
+}
+
+// Remove removes a key once no values are encrypted with it, such as after
+// KVStore.Reencrypt. Values still encrypted with it fail to decrypt with
+// ErrKVDecrypt. The current key can't be removed.
+func (kr *KVKeyring) Remove(id uint32) error {
+	if id == kr.current {
+		return fmt.Errorf("key %d is the current key", id)
+	}
+	delete(kr.aeads, id)
+	return nil
+}
+
+// Current returns the ID of the key used to encrypt new values
+func (kr *KVKeyring) Current() uint32 {
+	return kr.current
+}
+
+// DeriveKVKey derives a 32 byte key from secret with HKDF-SHA256, for use with
+// a KVKeyring. Using a different info for each purpose yields unrelated keys
+// from the same secret, such as one provided by the host.
+func DeriveKVKey(secret, salt []byte, info string) []byte {
+	if len(salt) == 0 {
+		salt = make([]byte, sha256.Size)
+	}
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(info))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+// KVEncrypt makes the KVStore encrypt values with AES-GCM using the keyring's
+// current key when setting them, and decrypt encrypted values when getting
+// them. The value's key, including the namespace, is authenticated along with
+// it, so an encrypted value copied to another key fails to decrypt.
+func KVEncrypt(keyring *KVKeyring) KVOption {
+	return func(s *KVStore) {
+		s.keyring = keyring
+	}
+}
+
+// sealValue encrypts value if the KVStore has a keyring. fullKey is the key
+// including the namespace.
+func (s *KVStore) sealValue(fullKey, value []byte) ([]byte, error) {
+	if s.keyring == nil {
+		return value, nil
+	}
+	aead := s.keyring.aeads[s.keyring.current]
+	b := kvEnvelopeHeader(kvEnvelopeEncrypted)
+	b = binary.BigEndian.AppendUint32(b, s.keyring.current)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("generating nonce: %w", err)
+	}
+	b = append(b, nonce...)
+	return aead.Seal(b, nonce, value, fullKey), nil
+}
+
+// openValue decrypts stored if it's encrypted, returning the ID of the key
+// that encrypted it. If stored isn't encrypted it's returned with encrypted
+// false.
+func (s *KVStore) openValue(fullKey, stored []byte) (value []byte, keyID uint32, encrypted bool, err error) {
+	b, encrypted := cutKVEnvelope(stored, kvEnvelopeEncrypted)
+	if !encrypted {
+		return stored, 0, false, nil
+	}
+	if s.keyring == nil {
+		return nil, 0, true, fmt.Errorf("%w: no keyring", ErrKVDecrypt)
+	}
+	if len(b) < 4 {
+		return nil, 0, true, fmt.Errorf("%w: truncated", ErrKVDecrypt)
+	}
+	keyID = binary.BigEndian.Uint32(b)
+	aead, present := s.keyring.aeads[keyID]
+	if !present {
+		return nil, keyID, true, fmt.Errorf("%w: unknown key %d", ErrKVDecrypt, keyID)
+	}
+	b = b[4:]
+	if len(b) < aead.NonceSize() {
+		return nil, keyID, true, fmt.Errorf("%w: truncated", ErrKVDecrypt)
+	}
+	value, err = aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], fullKey)
+	if err != nil {
+		return nil, keyID, true, fmt.Errorf("%w: %w", ErrKVDecrypt, err)
+	}
+	return value, keyID, true, nil
+}
+
+// Reencrypt re-encrypts the values matching prefix that weren't encrypted
+// with the keyring's current key, including values that weren't encrypted at
+// all, returning the number of values changed. It's used after
+// KVKeyring.Rotate so the old key can be removed with KVKeyring.Remove. Keys
+// deleted while Reencrypt runs are skipped.
+func (s *KVStore) Reencrypt(prefix []byte) (int, error) {
+	if s.keyring == nil {
+		return 0, errors.New("no keyring")
+	}
+	changed := 0
+	for key, err := range s.Keys(prefix, 0) {
+		if err != nil {
+			return changed, err
+		}
+		stored, err := s.getStored(key)
+		if errors.Is(err, akcore.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return changed, fmt.Errorf("getting %q: %w", key, err)
+		}
+		value, keyID, encrypted, err := s.openValue(s.key(key), stored)
+		if err != nil {
+			return changed, fmt.Errorf("decrypting %q: %w", key, err)
+		}
+		if encrypted && keyID == s.keyring.current {
+			continue
+		}
+		if err := s.setStored(key, value); err != nil {
+			return changed, fmt.Errorf("setting %q: %w", key, err)
+		}
+		changed++
+	}
+	return changed, nil
+}
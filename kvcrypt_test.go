@@ -0,0 +1,82 @@
+//go:build !wasm
+
+package core_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/autonomouskoi/akcore"
+	core "github.com/autonomouskoi/core-tinygo"
+	"github.com/autonomouskoi/core-tinygo/coretest"
+)
+
+func TestKVKeyringRotation(t *testing.T) {
+	coretest.New(t)
+	keyring, err := core.NewKVKeyring(1, bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := core.NewKVStore(core.KVEncrypt(keyring))
+	for _, key := range []string{"a", "b"} {
+		if err := kv.Set([]byte(key), []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := keyring.Rotate(2, bytes.Repeat([]byte{2}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	if err := keyring.Remove(2); err == nil {
+		t.Fatal("removed the current key")
+	}
+	for _, tc := range []struct {
+		name        string
+		wantChanged int
+	}{
+		{"rotated", 2},
+		{"already current", 0},
+	} {
+		changed, err := kv.Reencrypt(nil)
+		if err != nil || changed != tc.wantChanged {
+			t.Fatalf("%s: got %d, %v, want %d changed", tc.name, changed, err, tc.wantChanged)
+		}
+	}
+	if err := keyring.Remove(1); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := kv.Get([]byte("a")); err != nil || string(got) != "a" {
+		t.Fatalf("after removing old key: got %q, %v", got, err)
+	}
+	if err := keyring.Rotate(3, bytes.Repeat([]byte{3}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	if err := keyring.Remove(2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kv.Get([]byte("a")); !errors.Is(err, core.ErrKVDecrypt) {
+		t.Fatalf("got %v reading a value encrypted with a removed key, want ErrKVDecrypt", err)
+	}
+}
+
+func TestKVReencryptSkipsDeleted(t *testing.T) {
+	h := coretest.New(t)
+	keyring, err := core.NewKVKeyring(1, bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := core.NewKVStore(core.KVEncrypt(keyring), core.KVCached(core.NewKVCache(0, 0)))
+	if err := kv.Set([]byte("a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	// the cache remembers "gone" as missing while the host lists it, as when
+	// it's deleted between listing and getting
+	if _, err := kv.Get([]byte("gone")); !errors.Is(err, akcore.ErrNotFound) {
+		t.Fatal(err)
+	}
+	h.KVSet([]byte("gone"), []byte("x"))
+	changed, err := kv.Reencrypt(nil)
+	if err != nil || changed != 0 {
+		t.Fatalf("got %d, %v", changed, err)
+	}
+}
@@ -0,0 +1,27 @@
+package core
+
+import (
+	"bytes"
+)
+
+// Values stored by the KV layers in this package, such as versioned values,
+// start with a four byte header: a zero byte, "ak", and a byte identifying the
+// layer. Values without a recognized header are treated as plain values
+// written by KVSet.
+const (
+	kvEnvelopeVersioned  byte = 'V'
+	kvEnvelopeTTL        byte = 'T'
+	kvEnvelopeCompressed byte = 'Z'
+	kvEnvelopeEncrypted  byte = 'E'
+	kvEnvelopeChunked    byte = 'C'
+)
+
+func kvEnvelopeHeader(kind byte) []byte {
+	return []byte{0, 'a', 'k', kind}
+}
+
+// cutKVEnvelope returns value without the header for kind and whether value
+// had that header.
+func cutKVEnvelope(value []byte, kind byte) ([]byte, bool) {
+	return bytes.CutPrefix(value, kvEnvelopeHeader(kind))
+}
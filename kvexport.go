@@ -0,0 +1,188 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/autonomouskoi/akcore"
+)
+
+// An export stream starts with kvExportMagic and the format version as a
+// uvarint. Each entry follows as a KVSetRequest, preceded by its length plus
+// one as a uvarint. A 0 in place of the length marks the end of the entries
+// and is followed by the number of entries as a uvarint, so a truncated
+// stream is detected.
+const (
+	kvExportMagic   = "AKKV"
+	kvExportVersion = 1
+	// kvExportMaxRecord bounds the size of a record read by Import
+	kvExportMaxRecord = 64 * 1024 * 1024
+)
+
+// ErrKVExportFormat is returned, wrapped, by Import when the stream isn't a
+// KV export it can read.
+var ErrKVExportFormat = errors.New("invalid KV export")
+
+// KVImportMode controls how Import treats keys that already have a value
+type KVImportMode int
+
+const (
+	// KVImportOverwrite replaces existing values
+	KVImportOverwrite KVImportMode = 0
+	// KVImportSkipExisting leaves existing values in place
+	KVImportSkipExisting KVImportMode = 1
+	// KVImportDryRun reports what would change without setting anything.
+	// It's combined with the other modes.
+	KVImportDryRun KVImportMode = 2
+)
+
+// KVImportSummary describes what an Import changed, or would have changed in
+// a dry run.
+type KVImportSummary struct {
+	// Entries is the number of entries read
+	Entries int
+	// Created is the number of keys that had no value
+	Created int
+	// Updated is the number of keys whose value was replaced
+	Updated int
+	// Unchanged is the number of keys that already had the imported value
+	Unchanged int
+	// Skipped is the number of existing keys left alone by
+	// KVImportSkipExisting
+	Skipped int
+	// Changed holds the created and updated keys, in stream order
+	Changed [][]byte
+}
+
+// Export writes the keys matching prefix and their values to w as a portable,
+// versioned stream that can be restored with Import, returning the number of
+// entries written. Values are written as Get returns them, decrypted and
+// decompressed, so they can be imported by a KVStore with different options.
+// Keys are written without the KVStore's namespace. The chunks of values set
+// with SetChunked are only included when prefix is empty.
+func (s *KVStore) Export(prefix []byte, w io.Writer) (int, error) {
+	bw := bufio.NewWriter(w)
+	b := binary.AppendUvarint([]byte(kvExportMagic), kvExportVersion)
+	if _, err := bw.Write(b); err != nil {
+		return 0, fmt.Errorf("writing header: %w", err)
+	}
+	count := 0
+	for entry, err := range s.Entries(prefix, 0) {
+		if err != nil {
+			return count, err
+		}
+		record, err := (&KVSetRequest{Key: entry.Key, Value: entry.Value}).MarshalVT()
+		if err != nil {
+			return count, fmt.Errorf("marshalling %q: %w", entry.Key, err)
+		}
+		b = binary.AppendUvarint(b[:0], uint64(len(record))+1)
+		if _, err := bw.Write(append(b, record...)); err != nil {
+			return count, fmt.Errorf("writing %q: %w", entry.Key, err)
+		}
+		count++
+	}
+	b = binary.AppendUvarint(b[:0], 0)
+	b = binary.AppendUvarint(b, uint64(count))
+	if _, err := bw.Write(b); err != nil {
+		return count, fmt.Errorf("writing trailer: %w", err)
+	}
+	if err := bw.Flush(); err != nil {
+		return count, fmt.Errorf("writing: %w", err)
+	}
+	return count, nil
+}
+
+// Import reads a stream written by Export and sets its entries according to
+// mode, returning a summary of the changes. Entries are set as they're read,
+// so if the stream is truncated or corrupt the entries before the problem
+// have already been set; a dry run first will find such problems. The summary
+// is returned along with any error.
+func (s *KVStore) Import(r io.Reader, mode KVImportMode) (*KVImportSummary, error) {
+	br := bufio.NewReader(r)
+	summary := &KVImportSummary{}
+	magic := make([]byte, len(kvExportMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != kvExportMagic {
+		return summary, fmt.Errorf("%w: missing header", ErrKVExportFormat)
+	}
+	version, err := binary.ReadUvarint(br)
+	if err != nil {
+		return summary, fmt.Errorf("%w: reading version: %w", ErrKVExportFormat, err)
+	}
+	if version != kvExportVersion {
+		return summary, fmt.Errorf("%w: unsupported version %d", ErrKVExportFormat, version)
+	}
+	for {
+		length, err := binary.ReadUvarint(br)
+		if err != nil {
+			return summary, fmt.Errorf("%w: reading entry %d: %w", ErrKVExportFormat, summary.Entries, err)
+		}
+		if length == 0 {
+			break
+		}
+		if length-1 > kvExportMaxRecord {
+			return summary, fmt.Errorf("%w: entry %d too large", ErrKVExportFormat, summary.Entries)
+		}
+		record := make([]byte, length-1)
+		if _, err := io.ReadFull(br, record); err != nil {
+			return summary, fmt.Errorf("%w: reading entry %d: %w", ErrKVExportFormat, summary.Entries, err)
+		}
+		entry := &KVSetRequest{}
+		if err := entry.UnmarshalVT(record); err != nil {
+			return summary, fmt.Errorf("%w: decoding entry %d: %w", ErrKVExportFormat, summary.Entries, err)
+		}
+		summary.Entries++
+		if err := s.importEntry(entry.GetKey(), entry.GetValue(), mode, summary); err != nil {
+			return summary, fmt.Errorf("importing %q: %w", entry.GetKey(), err)
+		}
+	}
+	count, err := binary.ReadUvarint(br)
+	if err != nil {
+		return summary, fmt.Errorf("%w: reading trailer: %w", ErrKVExportFormat, err)
+	}
+	if count != uint64(summary.Entries) {
+		return summary, fmt.Errorf("%w: expected %d entries, read %d", ErrKVExportFormat, count, summary.Entries)
+	}
+	return summary, nil
+}
+
+func (s *KVStore) importEntry(key, value []byte, mode KVImportMode, summary *KVImportSummary) error {
+	existing, err := s.Get(key)
+	found := true
+	if errors.Is(err, akcore.ErrNotFound) {
+		found = false
+	} else if err != nil {
+		return fmt.Errorf("getting existing value: %w", err)
+	}
+	switch {
+	case found && mode&KVImportSkipExisting != 0:
+		summary.Skipped++
+		return nil
+	case found && bytes.Equal(existing, value):
+		summary.Unchanged++
+		return nil
+	case found:
+		summary.Updated++
+	default:
+		summary.Created++
+	}
+	summary.Changed = append(summary.Changed, key)
+	if mode&KVImportDryRun != 0 {
+		return nil
+	}
+	return s.Set(key, value)
+}
+
+// KVExport writes the keys in DefaultKV matching prefix and their values to w.
+// See KVStore.Export.
+func KVExport(prefix []byte, w io.Writer) (int, error) {
+	return DefaultKV.Export(prefix, w)
+}
+
+// KVImport sets the entries exported to r in DefaultKV. See KVStore.Import.
+func KVImport(r io.Reader, mode KVImportMode) (*KVImportSummary, error) {
+	return DefaultKV.Import(r, mode)
+}
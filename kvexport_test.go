@@ -0,0 +1,115 @@
+//go:build !wasm
+
+package core_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"testing"
+
+	core "github.com/autonomouskoi/core-tinygo"
+	"github.com/autonomouskoi/core-tinygo/coretest"
+)
+
+func TestKVExportFormat(t *testing.T) {
+	coretest.New(t)
+	kv := core.NewKVStore(core.KVNamespace([]byte("ns/")), core.KVCompress(1))
+	if err := kv.Set([]byte("k"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if n, err := kv.Export(nil, &buf); err != nil || n != 1 {
+		t.Fatalf("got %d, %v", n, err)
+	}
+	// the key is written without the namespace and the value uncompressed
+	record, err := (&core.KVSetRequest{Key: []byte("k"), Value: []byte("value")}).MarshalVT()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte("AKKV\x01")
+	want = binary.AppendUvarint(want, uint64(len(record))+1)
+	want = append(want, record...)
+	want = append(want, 0, 1)
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("got % x, want % x", buf.Bytes(), want)
+	}
+}
+
+func TestKVImport(t *testing.T) {
+	var export bytes.Buffer
+	coretest.New(t)
+	for _, key := range []string{"same", "new", "changed"} {
+		if err := core.KVSet([]byte(key), []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := core.KVExport(nil, &export); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name      string
+		mode      core.KVImportMode
+		want      core.KVImportSummary
+		wantValue string
+	}{
+		{"overwrite", core.KVImportOverwrite, core.KVImportSummary{
+			Entries: 3, Created: 1, Updated: 1, Unchanged: 1,
+			Changed: [][]byte{[]byte("changed"), []byte("new")},
+		}, "changed"},
+		{"skip existing", core.KVImportSkipExisting, core.KVImportSummary{
+			Entries: 3, Created: 1, Skipped: 2,
+			Changed: [][]byte{[]byte("new")},
+		}, "old"},
+		{"dry run", core.KVImportDryRun, core.KVImportSummary{
+			Entries: 3, Created: 1, Updated: 1, Unchanged: 1,
+			Changed: [][]byte{[]byte("changed"), []byte("new")},
+		}, "old"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := coretest.New(t)
+			h.KVSet([]byte("same"), []byte("same"))
+			h.KVSet([]byte("changed"), []byte("old"))
+			got, err := core.KVImport(bytes.NewReader(export.Bytes()), tc.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Entries != tc.want.Entries || got.Created != tc.want.Created ||
+				got.Updated != tc.want.Updated || got.Unchanged != tc.want.Unchanged ||
+				got.Skipped != tc.want.Skipped ||
+				!slices.EqualFunc(got.Changed, tc.want.Changed, bytes.Equal) {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+			if value, _ := h.KVGet([]byte("changed")); string(value) != tc.wantValue {
+				t.Errorf("got %q, want %q", value, tc.wantValue)
+			}
+		})
+	}
+}
+
+func TestKVImportInvalid(t *testing.T) {
+	valid := []byte("AKKV\x01\x00\x00")
+	for _, tc := range []struct {
+		name   string
+		stream []byte
+	}{
+		{"empty", nil},
+		{"bad magic", []byte("AKXV\x01\x00\x00")},
+		{"unsupported version", []byte("AKKV\x02\x00\x00")},
+		{"truncated record", []byte("AKKV\x01\x05\x0a")},
+		{"missing trailer", []byte("AKKV\x01\x00")},
+		{"wrong count", []byte("AKKV\x01\x00\x01")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			coretest.New(t)
+			if _, err := core.KVImport(bytes.NewReader(tc.stream), core.KVImportOverwrite); !errors.Is(err, core.ErrKVExportFormat) {
+				t.Fatalf("got %v, want ErrKVExportFormat", err)
+			}
+		})
+	}
+	coretest.New(t)
+	if _, err := core.KVImport(bytes.NewReader(valid), core.KVImportOverwrite); err != nil {
+		t.Fatalf("empty export: %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/autonomouskoi/akcore"
+)
+
+// kvIndexPrefix starts the keys of every KVTable index. Index keys are stored
+// alongside the table's prefix rather than under it so they don't appear as
+// records. Within an index, each key is an escaped index value followed by the
+// record's key.
+const kvIndexPrefix = "\x00idx/"
+
+// A KVIndexFunc extracts the values a record is indexed by. A record can have
+// any number of values in an index, including none.
+type KVIndexFunc[V any] func(V) [][]byte
+
+// AddIndex declares an index on the table. Put and Delete maintain the index
+// from then on, but existing records aren't indexed until RebuildIndexes is
+// called.
+func (t *KVTable[K, M, V]) AddIndex(name string, fn KVIndexFunc[V]) {
+	t.indexes[name] = fn
+}
+
+// indexRoot is the KVStore holding all of the table's indexes
+func (t *KVTable[K, M, V]) indexRoot() *KVStore {
+	return t.base.With(KVNamespace(appendKeyPart([]byte(kvIndexPrefix), t.prefix)))
+}
+
+func (t *KVTable[K, M, V]) indexKV(name string) *KVStore {
+	return t.indexRoot().With(KVNamespace(appendKeyPart(nil, []byte(name))))
+}
+
+// getIndexed gets the current value stored with key, or nil if there is none
+func (t *KVTable[K, M, V]) getIndexed(key []byte) (V, error) {
+	v := V(new(M))
+	err := t.kv.GetProto(key, v)
+	if errors.Is(err, akcore.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getting current value: %w", err)
+	}
+	return v, nil
+}
+
+// updateIndexes changes the index entries for key from those for old to those
+// for v. Either may be nil.
+func (t *KVTable[K, M, V]) updateIndexes(key []byte, old, v V) error {
+	for name, fn := range t.indexes {
+		var oldValues, newValues [][]byte
+		if old != nil {
+			oldValues = fn(old)
+		}
+		if v != nil {
+			newValues = fn(v)
+		}
+		ikv := t.indexKV(name)
+		for _, value := range oldValues {
+			if containsBytes(newValues, value) {
+				continue
+			}
+			if err := ikv.remove(append(appendKeyPart(nil, value), key...)); err != nil {
+				return fmt.Errorf("deleting from index %s: %w", name, err)
+			}
+		}
+		for _, value := range newValues {
+			if containsBytes(oldValues, value) {
+				continue
+			}
+			if err := ikv.set(append(appendKeyPart(nil, value), key...), nil); err != nil {
+				return fmt.Errorf("adding to index %s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func containsBytes(values [][]byte, value []byte) bool {
+	for _, v := range values {
+		if bytes.Equal(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// LookupKeys returns the keys of the records with value in the named index,
+// in key order.
+func (t *KVTable[K, M, V]) LookupKeys(index string, value []byte) ([]K, error) {
+	if _, present := t.indexes[index]; !present {
+		return nil, fmt.Errorf("no index %q", index)
+	}
+	var ks []K
+	for key, err := range t.indexKV(index).Keys(appendKeyPart(nil, value), 0) {
+		if err != nil {
+			return nil, err
+		}
+		_, recordKey, ok := cutKeyPart(key)
+		if !ok {
+			return nil, fmt.Errorf("invalid index key %q", key)
+		}
+		k, err := t.keys.DecodeKey(recordKey)
+		if err != nil {
+			return nil, fmt.Errorf("decoding key %q: %w", recordKey, err)
+		}
+		ks = append(ks, k)
+	}
+	return ks, nil
+}
+
+// Lookup returns the records with value in the named index, in key order.
+// Index entries for missing records are skipped.
+func (t *KVTable[K, M, V]) Lookup(index string, value []byte) ([]V, error) {
+	ks, err := t.LookupKeys(index, value)
+	if err != nil {
+		return nil, err
+	}
+	vs := make([]V, 0, len(ks))
+	for _, k := range ks {
+		v, err := t.Get(k)
+		if errors.Is(err, akcore.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		vs = append(vs, v)
+	}
+	return vs, nil
+}
+
+// RebuildIndexes deletes every index entry for the table, including those of
+// indexes no longer declared, and regenerates the entries for the declared
+// indexes from the stored records.
+func (t *KVTable[K, M, V]) RebuildIndexes() error {
+	root := t.indexRoot()
+	if _, err := root.deletePrefix(nil, root.remove); err != nil {
+		return fmt.Errorf("deleting indexes: %w", err)
+	}
+	var innerErr error
+	err := t.Scan(func(k K, v V) bool {
+		innerErr = t.updateIndexes(t.keys.EncodeKey(k), nil, v)
+		return innerErr == nil
+	})
+	if err != nil {
+		return fmt.Errorf("scanning: %w", err)
+	}
+	return innerErr
+}
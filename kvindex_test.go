@@ -0,0 +1,49 @@
+//go:build !wasm
+
+package core_test
+
+import (
+	"slices"
+	"testing"
+
+	core "github.com/autonomouskoi/core-tinygo"
+	"github.com/autonomouskoi/core-tinygo/coretest"
+)
+
+func TestKVIndexUnprefixedTable(t *testing.T) {
+	for _, prefix := range []string{"", "t/"} {
+		t.Run("prefix "+prefix, func(t *testing.T) {
+			coretest.New(t)
+			table := core.NewKVTable[string, core.KVSetRequest](nil, []byte(prefix), core.StringKey{})
+			table.AddIndex("value", func(v *core.KVSetRequest) [][]byte {
+				return [][]byte{v.GetValue()}
+			})
+			for _, k := range []string{"a", "b"} {
+				if err := table.Put(k, &core.KVSetRequest{Value: []byte("x")}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var scanned []string
+			err := table.Scan(func(k string, _ *core.KVSetRequest) bool {
+				scanned = append(scanned, k)
+				return true
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{"a", "b"}; !slices.Equal(scanned, want) {
+				t.Fatalf("scanned %q, want %q", scanned, want)
+			}
+			if err := table.RebuildIndexes(); err != nil {
+				t.Fatal(err)
+			}
+			keys, err := table.LookupKeys("value", []byte("x"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{"a", "b"}; !slices.Equal(keys, want) {
+				t.Errorf("looked up %q, want %q", keys, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"iter"
+
+	"github.com/autonomouskoi/akcore"
+)
+
+// ErrKVKeysShifted is yielded by KV iterators when keys before the current
+// position were added or deleted between pages, so keys may have been skipped.
+var ErrKVKeysShifted = errors.New("KV keys shifted between pages")
+
+// DefaultKVPageSize is the number of keys KV iterators request at a time by
+// default.
+const DefaultKVPageSize = 100
+
+// A KVEntry is a key and its value
+type KVEntry struct {
+	Key   []byte
+	Value []byte
+}
+
+// Keys returns an iterator over the keys matching prefix in key order. Keys
+// are requested pageSize at a time, or DefaultKVPageSize if pageSize is 0. If
+// listing fails or keys shift between pages, the error is yielded and
+// iteration ends.
+func (s *KVStore) Keys(prefix []byte, pageSize int) iter.Seq2[[]byte, error] {
+	if pageSize <= 0 {
+		pageSize = DefaultKVPageSize
+	}
+	return func(yield func([]byte, error) bool) {
+		var last []byte
+		for yielded := 0; ; {
+			// after the first page, overlap by one key to check that the
+			// keys haven't shifted
+			offset, limit := 0, pageSize
+			if last != nil {
+				offset, limit = yielded-1, pageSize+1
+			}
+			resp, err := s.List(prefix, limit, offset)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			keys := resp.GetKeys()
+			if last != nil {
+				if len(keys) == 0 || !bytes.Equal(keys[0], last) {
+					yield(nil, ErrKVKeysShifted)
+					return
+				}
+				keys = keys[1:]
+			}
+			for _, key := range keys {
+				if !yield(key, nil) {
+					return
+				}
+				last = key
+				yielded++
+			}
+			if len(keys) == 0 || yielded >= int(resp.GetTotalMatches()) {
+				return
+			}
+		}
+	}
+}
+
+// Entries returns an iterator over the keys matching prefix and their values,
+// paging as with Keys. Keys deleted before their value is retrieved are
+// skipped. If an error occurs it is yielded and iteration ends.
+func (s *KVStore) Entries(prefix []byte, pageSize int) iter.Seq2[KVEntry, error] {
+	return func(yield func(KVEntry, error) bool) {
+		for key, err := range s.Keys(prefix, pageSize) {
+			if err != nil {
+				yield(KVEntry{}, err)
+				return
+			}
+			value, err := s.Get(key)
+			if errors.Is(err, akcore.ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				yield(KVEntry{}, err)
+				return
+			}
+			if !yield(KVEntry{Key: key, Value: value}, nil) {
+				return
+			}
+		}
+	}
+}
+
+// KVKeys returns an iterator over keys matching prefix in DefaultKV. See
+// KVStore.Keys.
+func KVKeys(prefix []byte) iter.Seq2[[]byte, error] {
+	return DefaultKV.Keys(prefix, 0)
+}
+
+// KVEntries returns an iterator over keys matching prefix and their values in
+// DefaultKV. See KVStore.Entries.
+func KVEntries(prefix []byte) iter.Seq2[KVEntry, error] {
+	return DefaultKV.Entries(prefix, 0)
+}
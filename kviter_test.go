@@ -0,0 +1,58 @@
+//go:build !wasm
+
+package core_test
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	core "github.com/autonomouskoi/core-tinygo"
+	"github.com/autonomouskoi/core-tinygo/coretest"
+)
+
+func TestKVKeysPaging(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// change is called with the host after the first page is yielded
+		change  func(h *coretest.Host)
+		want    []string
+		wantErr error
+	}{
+		{"unchanged", func(*coretest.Host) {}, []string{"a", "b", "c", "d", "e"}, nil},
+		{"key added after position", func(h *coretest.Host) { h.KVSet([]byte("f"), nil) },
+			[]string{"a", "b", "c", "d", "e", "f"}, nil},
+		{"key added before position", func(h *coretest.Host) { h.KVSet([]byte("0"), nil) },
+			[]string{"a", "b"}, core.ErrKVKeysShifted},
+		{"key deleted before position", func(h *coretest.Host) {
+			if err := core.KVDelete([]byte("a")); err != nil {
+				t.Fatal(err)
+			}
+		}, []string{"a", "b"}, core.ErrKVKeysShifted},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := coretest.New(t)
+			for _, key := range []string{"a", "b", "c", "d", "e"} {
+				h.KVSet([]byte(key), nil)
+			}
+			var got []string
+			var gotErr error
+			for key, err := range core.DefaultKV.Keys(nil, 2) {
+				if err != nil {
+					gotErr = err
+					break
+				}
+				got = append(got, string(key))
+				if len(got) == 2 {
+					tc.change(h)
+				}
+			}
+			if !errors.Is(gotErr, tc.wantErr) {
+				t.Fatalf("got error %v, want %v", gotErr, tc.wantErr)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
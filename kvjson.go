@@ -0,0 +1,102 @@
+package core
+
+import (
+	"bytes"
+)
+
+// JSONMarshaller represents a proto that can be marshalled to JSON, as
+// generated for the types in this package.
+type JSONMarshaller interface {
+	MarshalJSON() ([]byte, error)
+}
+
+// JSONUnmarshaller represents a proto that can be unmarshalled from JSON
+type JSONUnmarshaller interface {
+	UnmarshalJSON([]byte) error
+}
+
+// JSONUnmarshallerPTR represents a value type where a pointer to that value
+// implements JSONUnmarshaller
+type JSONUnmarshallerPTR[M any] interface {
+	*M
+	JSONUnmarshaller
+}
+
+// ProtoOrJSONUnmarshaller represents a proto that can be unmarshalled from
+// either its binary or JSON encoding
+type ProtoOrJSONUnmarshaller interface {
+	Unmarshaller
+	JSONUnmarshaller
+}
+
+// SetJSON marshals p to JSON and sets key to that value, so the stored value
+// is readable when inspecting the KV store.
+func (s *KVStore) SetJSON(key []byte, p JSONMarshaller) error {
+	value, err := p.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	return s.Set(key, value)
+}
+
+// GetJSON retrieves the value associated with key and unmarshals it from JSON
+// into p.
+func (s *KVStore) GetJSON(key []byte, p JSONUnmarshaller) error {
+	value, err := s.Get(key)
+	if err != nil {
+		return err
+	}
+	return p.UnmarshalJSON(value)
+}
+
+// isJSONObject reports whether value is a JSON object rather than a binary
+// proto. A binary proto never starts with '{', which would begin a group for
+// field 15, and proto3 doesn't have groups. Leading whitespace isn't allowed
+// since it's also the start of common binary fields.
+func isJSONObject(value []byte) bool {
+	return bytes.HasPrefix(value, []byte("{"))
+}
+
+// GetProtoOrJSON retrieves the value associated with key and unmarshals it
+// into p, whether it was set with SetProto or SetJSON. It eases changing how
+// a value is stored without migrating existing values.
+func (s *KVStore) GetProtoOrJSON(key []byte, p ProtoOrJSONUnmarshaller) error {
+	value, err := s.Get(key)
+	if err != nil {
+		return err
+	}
+	if isJSONObject(value) {
+		return p.UnmarshalJSON(value)
+	}
+	return p.UnmarshalVT(value)
+}
+
+// KVSetJSON marshals p to JSON and sets key to that value in the KV store.
+func KVSetJSON(key []byte, p JSONMarshaller) error {
+	return DefaultKV.SetJSON(key, p)
+}
+
+// KVGetJSON retrieves the value associated with key from the KV store and
+// unmarshals it from JSON into p.
+func KVGetJSON(key []byte, p JSONUnmarshaller) error {
+	return DefaultKV.GetJSON(key, p)
+}
+
+// KVGetProtoOrJSON retrieves the value associated with key from the KV store
+// and unmarshals it into p, whether it was stored as a binary proto or JSON.
+func KVGetProtoOrJSON(key []byte, p ProtoOrJSONUnmarshaller) error {
+	return DefaultKV.GetProtoOrJSON(key, p)
+}
+
+// KVGetJSONAs retrieves the value associated with key from kv, or DefaultKV
+// if kv is nil, and unmarshals it from JSON into a new V.
+func KVGetJSONAs[M any, V JSONUnmarshallerPTR[M]](kv *KVStore, key []byte) (V, error) {
+	if kv == nil {
+		kv = DefaultKV
+	}
+	v := V(new(M))
+	if err := kv.GetJSON(key, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
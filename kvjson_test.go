@@ -0,0 +1,53 @@
+//go:build !wasm
+
+package core_test
+
+import (
+	"bytes"
+	"testing"
+
+	core "github.com/autonomouskoi/core-tinygo"
+	"github.com/autonomouskoi/core-tinygo/coretest"
+)
+
+func TestKVGetProtoOrJSON(t *testing.T) {
+	want := &core.KVSetRequest{Key: []byte("{k}"), Value: []byte("v")}
+	for _, tc := range []struct {
+		name     string
+		set      func(key []byte) error
+		want     *core.KVSetRequest
+		wantJSON bool
+	}{
+		{"proto", func(key []byte) error { return core.KVSetProto(key, want) }, want, false},
+		{"json", func(key []byte) error { return core.KVSetJSON(key, want) }, want, true},
+		{"empty proto", func(key []byte) error { return core.KVSetProto(key, &core.KVSetRequest{}) }, &core.KVSetRequest{}, false},
+		{"empty json", func(key []byte) error { return core.KVSetJSON(key, &core.KVSetRequest{}) }, &core.KVSetRequest{}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := coretest.New(t)
+			key := []byte("k")
+			if err := tc.set(key); err != nil {
+				t.Fatal(err)
+			}
+			stored, _ := h.KVGet(key)
+			if isJSON := bytes.HasPrefix(stored, []byte("{")); isJSON != tc.wantJSON {
+				t.Fatalf("stored %q, want JSON %t", stored, tc.wantJSON)
+			}
+			got := &core.KVSetRequest{}
+			if err := core.KVGetProtoOrJSON(key, got); err != nil {
+				t.Fatal(err)
+			}
+			if !got.EqualVT(tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+			// KVGetJSONAs only reads values stored as JSON
+			asJSON, err := core.KVGetJSONAs[core.KVSetRequest](nil, key)
+			if tc.wantJSON && (err != nil || !asJSON.EqualVT(tc.want)) {
+				t.Errorf("got %v, %v from KVGetJSONAs, want %v", asJSON, err, tc.want)
+			}
+			if !tc.wantJSON && len(stored) > 0 && err == nil {
+				t.Errorf("KVGetJSONAs read a binary proto as %v", asJSON)
+			}
+		})
+	}
+}
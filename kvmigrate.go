@@ -0,0 +1,159 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/autonomouskoi/akcore"
+)
+
+// Keys reserved by KVMigrator in the KVStore it migrates
+var (
+	kvSchemaVersionKey  = []byte("\x00schema/version")
+	kvSchemaProgressKey = []byte("\x00schema/progress")
+)
+
+// KVMigrationFunc migrates stored data to a new schema version. A migration
+// interrupted by a crash is run again from the start, so it should either be
+// safe to repeat or record its progress with Checkpoint.
+type KVMigrationFunc func(m *KVMigration) error
+
+// A KVMigration is a migration being applied by a KVMigrator
+type KVMigration struct {
+	// KV is the KVStore being migrated
+	KV          *KVStore
+	Version     int
+	Description string
+	fn          KVMigrationFunc
+	checkpoint  []byte
+}
+
+// Resume returns the data last passed to Checkpoint if this migration was
+// interrupted, or nil.
+func (m *KVMigration) Resume() []byte {
+	return m.checkpoint
+}
+
+// Checkpoint records the migration's progress. If the migration is
+// interrupted, the next attempt can continue from data using Resume.
+func (m *KVMigration) Checkpoint(data []byte) error {
+	b := binary.AppendUvarint(nil, uint64(m.Version))
+	if err := m.KV.set(kvSchemaProgressKey, append(b, data...)); err != nil {
+		return fmt.Errorf("setting progress: %w", err)
+	}
+	m.checkpoint = data
+	return nil
+}
+
+// A KVMigrator applies ordered migrations to a KVStore, each exactly once.
+// The current schema version is stored in a reserved key in the KVStore.
+type KVMigrator struct {
+	kv         *KVStore
+	migrations []*KVMigration
+}
+
+// NewKVMigrator creates a KVMigrator for kv. If kv is nil, DefaultKV is used.
+func NewKVMigrator(kv *KVStore) *KVMigrator {
+	if kv == nil {
+		kv = DefaultKV
+	}
+	return &KVMigrator{kv: kv}
+}
+
+// Add registers fn to migrate data to version, which must be greater than 0.
+// Migrations are applied in version order regardless of the order they're
+// added.
+func (m *KVMigrator) Add(version int, description string, fn KVMigrationFunc) {
+	m.migrations = append(m.migrations, &KVMigration{
+		KV:          m.kv,
+		Version:     version,
+		Description: description,
+		fn:          fn,
+	})
+}
+
+// Version returns the current schema version. A KVStore that has never been
+// migrated is at version 0.
+func (m *KVMigrator) Version() (int, error) {
+	b, err := m.kv.Get(kvSchemaVersionKey)
+	if errors.Is(err, akcore.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	version, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, errors.New("invalid schema version")
+	}
+	return int(version), nil
+}
+
+// progress returns the checkpoint recorded for version, if any
+func (m *KVMigrator) progress(version int) ([]byte, error) {
+	b, err := m.kv.Get(kvSchemaProgressKey)
+	if errors.Is(err, akcore.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	progressVersion, n := binary.Uvarint(b)
+	if n <= 0 || int(progressVersion) != version {
+		return nil, nil
+	}
+	return b[n:], nil
+}
+
+// Run applies the migrations with versions greater than the current schema
+// version, in order, recording the new version after each one. Each migration
+// is logged with LogInfo before it's applied. If a migration fails, Run stops and returns the error;
+// the next Run resumes with that migration.
+func (m *KVMigrator) Run() error {
+	sort.SliceStable(m.migrations, func(i, j int) bool {
+		return m.migrations[i].Version < m.migrations[j].Version
+	})
+	for i, migration := range m.migrations {
+		if migration.Version <= 0 {
+			return fmt.Errorf("invalid migration version %d", migration.Version)
+		}
+		if i > 0 && m.migrations[i-1].Version == migration.Version {
+			return fmt.Errorf("duplicate migration version %d", migration.Version)
+		}
+	}
+	current, err := m.Version()
+	if err != nil {
+		return fmt.Errorf("getting schema version: %w", err)
+	}
+	for _, migration := range m.migrations {
+		if migration.Version <= current {
+			continue
+		}
+		if migration.checkpoint, err = m.progress(migration.Version); err != nil {
+			return fmt.Errorf("getting migration progress: %w", err)
+		}
+		LogInfo("applying KV migration",
+			"version", int64(migration.Version),
+			"description", migration.Description,
+			"resuming", migration.checkpoint != nil,
+		)
+		if err := migration.fn(migration); err != nil {
+			LogError("KV migration failed",
+				"version", int64(migration.Version),
+				"error", err.Error(),
+			)
+			return fmt.Errorf("migrating to version %d: %w", migration.Version, err)
+		}
+		if err := m.kv.set(kvSchemaVersionKey, binary.AppendUvarint(nil, uint64(migration.Version))); err != nil {
+			return fmt.Errorf("setting schema version: %w", err)
+		}
+		// a leftover checkpoint is ignored since its version is now applied
+		if err := m.kv.remove(kvSchemaProgressKey); err != nil {
+			return fmt.Errorf("deleting migration progress: %w", err)
+		}
+		current = migration.Version
+	}
+	return nil
+}
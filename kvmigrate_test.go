@@ -0,0 +1,102 @@
+//go:build !wasm
+
+package core_test
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"testing"
+
+	core "github.com/autonomouskoi/core-tinygo"
+	"github.com/autonomouskoi/core-tinygo/coretest"
+)
+
+func TestKVMigratorRun(t *testing.T) {
+	h := coretest.New(t)
+	var applied []int
+	record := func(m *core.KVMigration) error {
+		applied = append(applied, m.Version)
+		return nil
+	}
+	for _, tc := range []struct {
+		name        string
+		versions    []int
+		want        []int
+		wantVersion int
+	}{
+		{"out of order", []int{2, 1}, []int{1, 2}, 2},
+		{"already applied", []int{1, 2}, nil, 2},
+		{"new migration", []int{1, 2, 3}, []int{3}, 3},
+	} {
+		applied = nil
+		h.ClearOutbox()
+		m := core.NewKVMigrator(nil)
+		for _, version := range tc.versions {
+			m.Add(version, "test", record)
+		}
+		if err := m.Run(); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !slices.Equal(applied, tc.want) {
+			t.Errorf("%s: applied %v, want %v", tc.name, applied, tc.want)
+		}
+		if version, err := m.Version(); err != nil || version != tc.wantVersion {
+			t.Errorf("%s: got version %d, %v, want %d", tc.name, version, err, tc.wantVersion)
+		}
+		// one log per migration applied
+		if logs := h.Logs(); len(logs) != len(tc.want) {
+			t.Errorf("%s: got %d logs, want %d", tc.name, len(logs), len(tc.want))
+		}
+	}
+}
+
+func TestKVMigratorResume(t *testing.T) {
+	h := coretest.New(t)
+	crash := errors.New("crash")
+	var resumed [][]byte
+	migrate := func(m *core.KVMigration) error {
+		resumed = append(resumed, m.Resume())
+		if m.Resume() == nil {
+			if err := m.Checkpoint([]byte("halfway")); err != nil {
+				return err
+			}
+			return crash
+		}
+		return nil
+	}
+	for _, tc := range []struct {
+		name        string
+		wantErr     error
+		wantVersion int
+		wantLevels  []core.LogLevel
+	}{
+		{"crash", crash, 0, []core.LogLevel{core.LogLevel_INFO, core.LogLevel_ERROR}},
+		{"resume", nil, 1, []core.LogLevel{core.LogLevel_INFO}},
+	} {
+		h.ClearOutbox()
+		m := core.NewKVMigrator(nil)
+		m.Add(1, "test", migrate)
+		if err := m.Run(); !errors.Is(err, tc.wantErr) {
+			t.Fatalf("%s: got %v, want %v", tc.name, err, tc.wantErr)
+		}
+		if version, err := m.Version(); err != nil || version != tc.wantVersion {
+			t.Errorf("%s: got version %d, %v, want %d", tc.name, version, err, tc.wantVersion)
+		}
+		var levels []core.LogLevel
+		for _, log := range h.Logs() {
+			levels = append(levels, log.GetLevel())
+		}
+		if !slices.Equal(levels, tc.wantLevels) {
+			t.Errorf("%s: got log levels %v, want %v", tc.name, levels, tc.wantLevels)
+		}
+	}
+	if len(resumed) != 2 || resumed[0] != nil || string(resumed[1]) != "halfway" {
+		t.Errorf("got resume data %q, want nil then %q", resumed, "halfway")
+	}
+	for _, key := range h.KVKeys() {
+		if bytes.Equal(key, []byte("\x00schema/progress")) {
+			t.Error("progress left after the migration was applied")
+		}
+	}
+}
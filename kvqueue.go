@@ -0,0 +1,307 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"iter"
+	"time"
+
+	"github.com/autonomouskoi/akcore"
+)
+
+// Defaults for a KVQueue
+const (
+	DefaultKVQueueLease       = 30 * time.Second
+	DefaultKVQueueMaxAttempts = 5
+)
+
+// ErrKVQueueLeaseLost is returned by Ack and Nack when the item isn't leased,
+// such as when its lease expired and it was dequeued again.
+var ErrKVQueueLeaseLost = errors.New("queue item lease lost")
+
+// Within a queue's namespace, the next ID is stored in kvQueueSeqKey and each
+// item is stored with its state's prefix followed by its ID, so items of
+// each state are listed in the order they were enqueued.
+var (
+	kvQueueSeqKey      = []byte("seq")
+	kvQueueReadyPrefix = []byte("r/")
+	kvQueueLeasePrefix = []byte("l/")
+	kvQueueDeadPrefix  = []byte("d/")
+)
+
+// A KVQueueItem is an item in a KVQueue
+type KVQueueItem struct {
+	// ID identifies the item within the queue. IDs increase in the order
+	// items are enqueued.
+	ID uint64
+	// Attempts is the number of times the item has been dequeued
+	Attempts int
+	// LeaseExpires is when the item will be dequeued again if it isn't
+	// acknowledged. It's zero for items that aren't leased.
+	LeaseExpires time.Time
+	Value        []byte
+}
+
+func (item *KVQueueItem) encode() []byte {
+	b := binary.AppendUvarint(nil, uint64(item.Attempts))
+	var expires int64
+	if !item.LeaseExpires.IsZero() {
+		expires = item.LeaseExpires.UnixMilli()
+	}
+	b = binary.BigEndian.AppendUint64(b, uint64(expires))
+	return append(b, item.Value...)
+}
+
+func decodeKVQueueItem(key, stored []byte) (*KVQueueItem, error) {
+	if len(key) != 8 {
+		return nil, fmt.Errorf("invalid item key %q", key)
+	}
+	item := &KVQueueItem{ID: binary.BigEndian.Uint64(key)}
+	attempts, n := binary.Uvarint(stored)
+	if n <= 0 || len(stored) < n+8 {
+		return nil, fmt.Errorf("invalid item %d", item.ID)
+	}
+	item.Attempts = int(attempts)
+	if expires := int64(binary.BigEndian.Uint64(stored[n:])); expires != 0 {
+		item.LeaseExpires = time.UnixMilli(expires)
+	}
+	item.Value = stored[n+8:]
+	return item, nil
+}
+
+func kvQueueKey(prefix []byte, id uint64) []byte {
+	return binary.BigEndian.AppendUint64(append([]byte{}, prefix...), id)
+}
+
+// A KVQueue is a persistent FIFO queue stored in KV. Dequeued items are
+// leased: they're hidden from other dequeues until they're acknowledged with
+// Ack, returned with Nack, or their lease expires. An item dequeued
+// MaxAttempts times without being acknowledged is moved to the dead letters
+// rather than being returned to the queue.
+//
+// Moving an item between states takes two requests, so an item may be
+// delivered more than once if the plugin stops between them. Handlers should
+// tolerate repeated items.
+type KVQueue struct {
+	// Lease is how long a dequeued item is hidden before it's dequeued again
+	Lease time.Duration
+	// MaxAttempts is the number of times an item is dequeued before it's
+	// moved to the dead letters. 0 means no limit.
+	MaxAttempts int
+	kv          *KVStore
+}
+
+// NewKVQueue creates a KVQueue storing its items in kv under prefix, with the
+// default lease and maximum attempts. If kv is nil, DefaultKV is used.
+func NewKVQueue(kv *KVStore, prefix []byte) *KVQueue {
+	if kv == nil {
+		kv = DefaultKV
+	}
+	return &KVQueue{
+		Lease:       DefaultKVQueueLease,
+		MaxAttempts: DefaultKVQueueMaxAttempts,
+		kv:          kv.With(KVNamespace(prefix)),
+	}
+}
+
+// Enqueue adds value to the end of the queue, returning its ID
+func (q *KVQueue) Enqueue(value []byte) (uint64, error) {
+	var id uint64
+	b, err := q.kv.Get(kvQueueSeqKey)
+	if err == nil {
+		var n int
+		if id, n = binary.Uvarint(b); n <= 0 {
+			return 0, errors.New("invalid queue sequence")
+		}
+	} else if !errors.Is(err, akcore.ErrNotFound) {
+		return 0, fmt.Errorf("getting sequence: %w", err)
+	}
+	// the sequence is advanced first so an ID is never reused, even if the
+	// item isn't stored
+	if err := q.kv.set(kvQueueSeqKey, binary.AppendUvarint(nil, id+1)); err != nil {
+		return 0, fmt.Errorf("setting sequence: %w", err)
+	}
+	item := &KVQueueItem{ID: id, Value: value}
+	if err := q.kv.set(kvQueueKey(kvQueueReadyPrefix, id), item.encode()); err != nil {
+		return 0, fmt.Errorf("setting item: %w", err)
+	}
+	return id, nil
+}
+
+// move stores item under the prefix to and deletes it from the prefix from
+func (q *KVQueue) move(item *KVQueueItem, from, to []byte) error {
+	if err := q.kv.set(kvQueueKey(to, item.ID), item.encode()); err != nil {
+		return fmt.Errorf("setting item %d: %w", item.ID, err)
+	}
+	if err := q.kv.remove(kvQueueKey(from, item.ID)); err != nil {
+		return fmt.Errorf("deleting item %d: %w", item.ID, err)
+	}
+	return nil
+}
+
+// release returns a leased item to the queue, or to the dead letters if it
+// has been attempted MaxAttempts times.
+func (q *KVQueue) release(item *KVQueueItem) error {
+	item.LeaseExpires = time.Time{}
+	to := kvQueueReadyPrefix
+	if q.MaxAttempts > 0 && item.Attempts >= q.MaxAttempts {
+		to = kvQueueDeadPrefix
+	}
+	return q.move(item, kvQueueLeasePrefix, to)
+}
+
+// expireLeases releases the items whose leases have expired
+func (q *KVQueue) expireLeases() error {
+	now := q.kv.now()
+	var expired []*KVQueueItem
+	for entry, err := range q.kv.Entries(kvQueueLeasePrefix, 0) {
+		if err != nil {
+			return err
+		}
+		item, err := decodeKVQueueItem(entry.Key[len(kvQueueLeasePrefix):], entry.Value)
+		if err != nil {
+			return err
+		}
+		if !item.LeaseExpires.After(now) {
+			expired = append(expired, item)
+		}
+	}
+	for _, item := range expired {
+		if err := q.release(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Dequeue leases the item at the front of the queue, returning nil if the
+// queue is empty. Items whose leases have expired are returned to the queue
+// first, keeping their place.
+func (q *KVQueue) Dequeue() (*KVQueueItem, error) {
+	if err := q.expireLeases(); err != nil {
+		return nil, fmt.Errorf("expiring leases: %w", err)
+	}
+	for entry, err := range q.kv.Entries(kvQueueReadyPrefix, 1) {
+		if err != nil {
+			return nil, err
+		}
+		item, err := decodeKVQueueItem(entry.Key[len(kvQueueReadyPrefix):], entry.Value)
+		if err != nil {
+			return nil, err
+		}
+		item.Attempts++
+		item.LeaseExpires = q.kv.now().Add(q.Lease)
+		if err := q.move(item, kvQueueReadyPrefix, kvQueueLeasePrefix); err != nil {
+			return nil, err
+		}
+		return item, nil
+	}
+	return nil, nil
+}
+
+// leased gets the stored lease for item, returning ErrKVQueueLeaseLost if
+// it's not the lease item was dequeued with.
+func (q *KVQueue) leased(item *KVQueueItem) (*KVQueueItem, error) {
+	key := kvQueueKey(kvQueueLeasePrefix, item.ID)
+	stored, err := q.kv.Get(key)
+	if errors.Is(err, akcore.ErrNotFound) {
+		return nil, fmt.Errorf("item %d: %w", item.ID, ErrKVQueueLeaseLost)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getting item %d: %w", item.ID, err)
+	}
+	leased, err := decodeKVQueueItem(key[len(kvQueueLeasePrefix):], stored)
+	if err != nil {
+		return nil, err
+	}
+	// a later dequeue of the same item has more attempts and a later expiry
+	if leased.Attempts != item.Attempts || leased.LeaseExpires.UnixMilli() != item.LeaseExpires.UnixMilli() {
+		return nil, fmt.Errorf("item %d: %w", item.ID, ErrKVQueueLeaseLost)
+	}
+	return leased, nil
+}
+
+// Ack removes a dequeued item from the queue once it has been processed
+func (q *KVQueue) Ack(item *KVQueueItem) error {
+	if _, err := q.leased(item); err != nil {
+		return err
+	}
+	return q.kv.remove(kvQueueKey(kvQueueLeasePrefix, item.ID))
+}
+
+// Nack returns a dequeued item that couldn't be processed to the queue,
+// keeping its place, or moves it to the dead letters if it has been attempted
+// MaxAttempts times.
+func (q *KVQueue) Nack(item *KVQueueItem) error {
+	leased, err := q.leased(item)
+	if err != nil {
+		return err
+	}
+	return q.release(leased)
+}
+
+// KVQueueDepth is the number of items in each state of a KVQueue
+type KVQueueDepth struct {
+	Ready  int
+	Leased int
+	Dead   int
+}
+
+// Depth returns the number of items in the queue by state
+func (q *KVQueue) Depth() (KVQueueDepth, error) {
+	var depth KVQueueDepth
+	for _, count := range []struct {
+		prefix []byte
+		n      *int
+	}{
+		{kvQueueReadyPrefix, &depth.Ready},
+		{kvQueueLeasePrefix, &depth.Leased},
+		{kvQueueDeadPrefix, &depth.Dead},
+	} {
+		resp, err := q.kv.List(count.prefix, 1, 0)
+		if err != nil {
+			return depth, fmt.Errorf("listing %q: %w", count.prefix, err)
+		}
+		*count.n = int(resp.GetTotalMatches())
+	}
+	return depth, nil
+}
+
+// Dead returns an iterator over the dead letters, the items attempted
+// MaxAttempts times, in the order they were enqueued.
+func (q *KVQueue) Dead() iter.Seq2[*KVQueueItem, error] {
+	return func(yield func(*KVQueueItem, error) bool) {
+		for entry, err := range q.kv.Entries(kvQueueDeadPrefix, 0) {
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			item, err := decodeKVQueueItem(entry.Key[len(kvQueueDeadPrefix):], entry.Value)
+			if !yield(item, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Requeue returns the dead letter with id to the queue, keeping its place,
+// with its attempts reset.
+func (q *KVQueue) Requeue(id uint64) error {
+	key := kvQueueKey(kvQueueDeadPrefix, id)
+	stored, err := q.kv.Get(key)
+	if err != nil {
+		return fmt.Errorf("getting item %d: %w", id, err)
+	}
+	item, err := decodeKVQueueItem(key[len(kvQueueDeadPrefix):], stored)
+	if err != nil {
+		return err
+	}
+	item.Attempts = 0
+	return q.move(item, kvQueueDeadPrefix, kvQueueReadyPrefix)
+}
+
+// PurgeDead deletes the dead letters, returning the number deleted
+func (q *KVQueue) PurgeDead() (int, error) {
+	return q.kv.deletePrefix(kvQueueDeadPrefix, q.kv.remove)
+}
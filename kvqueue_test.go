@@ -0,0 +1,117 @@
+//go:build !wasm
+
+package core_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	core "github.com/autonomouskoi/core-tinygo"
+	"github.com/autonomouskoi/core-tinygo/coretest"
+)
+
+func newTestQueue(t *testing.T) (*core.KVQueue, *time.Time) {
+	t.Helper()
+	coretest.New(t)
+	now := time.UnixMilli(1_000_000)
+	kv := core.NewKVStore(core.KVClock(func() time.Time { return now }))
+	return core.NewKVQueue(kv, []byte("q/")), &now
+}
+
+func TestKVQueueOrder(t *testing.T) {
+	q, _ := newTestQueue(t)
+	for _, v := range []string{"a", "b", "c"} {
+		if _, err := q.Enqueue([]byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"a", "b", "c"} {
+		item, err := q.Dequeue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(item.Value); got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+		if err := q.Ack(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	item, err := q.Dequeue()
+	if err != nil || item != nil {
+		t.Fatalf("got %v, %v from empty queue", item, err)
+	}
+}
+
+func TestKVQueueLeases(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// settle is called with the first and second dequeue of the same item
+		settle func(q *core.KVQueue, first, second *core.KVQueueItem) error
+	}{
+		{"stale ack", func(q *core.KVQueue, first, _ *core.KVQueueItem) error { return q.Ack(first) }},
+		{"stale nack", func(q *core.KVQueue, first, _ *core.KVQueueItem) error { return q.Nack(first) }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			q, now := newTestQueue(t)
+			if _, err := q.Enqueue([]byte("a")); err != nil {
+				t.Fatal(err)
+			}
+			first, err := q.Dequeue()
+			if err != nil {
+				t.Fatal(err)
+			}
+			*now = now.Add(q.Lease)
+			second, err := q.Dequeue()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if second == nil || second.ID != first.ID || second.Attempts != 2 {
+				t.Fatalf("expired item not redelivered: %+v", second)
+			}
+			if err := tc.settle(q, first, second); !errors.Is(err, core.ErrKVQueueLeaseLost) {
+				t.Fatalf("got %v, want ErrKVQueueLeaseLost", err)
+			}
+			if err := q.Ack(second); err != nil {
+				t.Fatalf("acking current lease: %v", err)
+			}
+		})
+	}
+}
+
+func TestKVQueueDeadLetters(t *testing.T) {
+	q, _ := newTestQueue(t)
+	q.MaxAttempts = 2
+	if _, err := q.Enqueue([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		item, err := q.Dequeue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := q.Nack(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	depth, err := q.Depth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (core.KVQueueDepth{Dead: 1}); depth != want {
+		t.Fatalf("got %+v, want %+v", depth, want)
+	}
+	for item, err := range q.Dead() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := q.Requeue(item.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	item, err := q.Dequeue()
+	if err != nil || item == nil || item.Attempts != 1 {
+		t.Fatalf("requeued item: %+v, %v", item, err)
+	}
+}
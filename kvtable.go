@@ -0,0 +1,242 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/autonomouskoi/akcore"
+)
+
+// ProtoPTR represents a value type where a pointer to that value is a proto
+// that can be marshalled and unmarshalled
+type ProtoPTR[M any] interface {
+	*M
+	Marshaller
+	Unmarshaller
+}
+
+// A KeyCodec converts keys of type K to and from their representation in the
+// KV store. Encoded keys should sort in the same order as the keys they
+// represent.
+type KeyCodec[K any] interface {
+	EncodeKey(K) []byte
+	DecodeKey([]byte) (K, error)
+}
+
+// StringKey is a KeyCodec for string keys, stored as their bytes
+type StringKey struct{}
+
+// EncodeKey implements KeyCodec
+func (StringKey) EncodeKey(k string) []byte {
+	return []byte(k)
+}
+
+// DecodeKey implements KeyCodec
+func (StringKey) DecodeKey(b []byte) (string, error) {
+	return string(b), nil
+}
+
+// Int64Key is a KeyCodec for int64 keys, stored as 8 big-endian bytes with
+// the sign bit flipped so negative keys sort before positive ones.
+type Int64Key struct{}
+
+// EncodeKey implements KeyCodec
+func (Int64Key) EncodeKey(k int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(k)^(1<<63))
+}
+
+// DecodeKey implements KeyCodec
+func (Int64Key) DecodeKey(b []byte) (int64, error) {
+	if len(b) != 8 {
+		return 0, fmt.Errorf("invalid int64 key length %d", len(b))
+	}
+	return int64(binary.BigEndian.Uint64(b) ^ (1 << 63)), nil
+}
+
+// A Pair is a key made of two parts, used with PairKey
+type Pair[A, B any] struct {
+	First  A
+	Second B
+}
+
+// PairKey is a KeyCodec for composite keys. The first part is escaped and
+// terminated so that keys sort by their first part, then by their second.
+type PairKey[A, B any] struct {
+	First  KeyCodec[A]
+	Second KeyCodec[B]
+}
+
+// EncodeKey implements KeyCodec
+func (c PairKey[A, B]) EncodeKey(k Pair[A, B]) []byte {
+	b := appendKeyPart(nil, c.First.EncodeKey(k.First))
+	return append(b, c.Second.EncodeKey(k.Second)...)
+}
+
+// DecodeKey implements KeyCodec
+func (c PairKey[A, B]) DecodeKey(b []byte) (Pair[A, B], error) {
+	var k Pair[A, B]
+	first, rest, ok := cutKeyPart(b)
+	if !ok {
+		return k, errors.New("invalid pair key")
+	}
+	var err error
+	if k.First, err = c.First.DecodeKey(first); err != nil {
+		return k, fmt.Errorf("decoding first: %w", err)
+	}
+	if k.Second, err = c.Second.DecodeKey(rest); err != nil {
+		return k, fmt.Errorf("decoding second: %w", err)
+	}
+	return k, nil
+}
+
+// appendKeyPart appends part to b, escaping zero bytes as 0x00 0xff and
+// terminating it with 0x00 0x01 so that keys starting with the part sort by
+// the part first.
+func appendKeyPart(b, part []byte) []byte {
+	for _, ch := range part {
+		b = append(b, ch)
+		if ch == 0 {
+			b = append(b, 0xff)
+		}
+	}
+	return append(b, 0, 1)
+}
+
+// cutKeyPart reverses appendKeyPart, returning the part at the start of b and
+// the bytes following it.
+func cutKeyPart(b []byte) ([]byte, []byte, bool) {
+	part := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		if b[i] != 0 {
+			part = append(part, b[i])
+			continue
+		}
+		if i+1 < len(b) && b[i+1] == 0xff {
+			part = append(part, 0)
+			i++
+			continue
+		}
+		if i+1 < len(b) && b[i+1] == 1 {
+			return part, b[i+2:], true
+		}
+		break
+	}
+	return nil, nil, false
+}
+
+// A KVTable stores proto values of type V with keys of type K under a common
+// key prefix. M is the type V points to, e.g.
+//
+//	users := core.NewKVTable[string, pb.User](nil, []byte("users/"), core.StringKey{})
+type KVTable[K, M any, V ProtoPTR[M]] struct {
+	kv      *KVStore
+	keys    KeyCodec[K]
+	base    *KVStore
+	prefix  []byte
+	indexes map[string]KVIndexFunc[V]
+}
+
+// NewKVTable creates a KVTable storing values in kv with the given key prefix.
+// If kv is nil, DefaultKV is used.
+func NewKVTable[K, M any, V ProtoPTR[M]](kv *KVStore, prefix []byte, keys KeyCodec[K]) *KVTable[K, M, V] {
+	if kv == nil {
+		kv = DefaultKV
+	}
+	return &KVTable[K, M, V]{
+		kv:      kv.With(KVNamespace(prefix)),
+		keys:    keys,
+		base:    kv,
+		prefix:  bytes.Clone(prefix),
+		indexes: map[string]KVIndexFunc[V]{},
+	}
+}
+
+// Get retrieves the value for k. If there is no such value akcore.ErrNotFound
+// is returned.
+func (t *KVTable[K, M, V]) Get(k K) (V, error) {
+	v := V(new(M))
+	if err := t.kv.GetProto(t.keys.EncodeKey(k), v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Put stores v with k, overwriting any existing value. The table's indexes are
+// updated to match.
+func (t *KVTable[K, M, V]) Put(k K, v V) error {
+	key := t.keys.EncodeKey(k)
+	if len(t.indexes) == 0 {
+		return t.kv.SetProto(key, v)
+	}
+	old, err := t.getIndexed(key)
+	if err != nil {
+		return err
+	}
+	if err := t.kv.SetProto(key, v); err != nil {
+		return err
+	}
+	return t.updateIndexes(key, old, v)
+}
+
+// Delete deletes the value for k. If there is no such value no error is
+// returned. The value's index entries are also deleted.
+func (t *KVTable[K, M, V]) Delete(k K) error {
+	key := t.keys.EncodeKey(k)
+	if len(t.indexes) == 0 {
+		return t.kv.Delete(key)
+	}
+	old, err := t.getIndexed(key)
+	if err != nil {
+		return err
+	}
+	if err := t.kv.Delete(key); err != nil {
+		return err
+	}
+	return t.updateIndexes(key, old, nil)
+}
+
+// Exists reports whether there's a value for k without retrieving it.
+func (t *KVTable[K, M, V]) Exists(k K) (bool, error) {
+	key := t.keys.EncodeKey(k)
+	resp, err := t.kv.List(key, 1, 0)
+	if err != nil {
+		return false, err
+	}
+	keys := resp.GetKeys()
+	return len(keys) > 0 && bytes.Equal(keys[0], key), nil
+}
+
+// Scan calls fn with each key and value in the table in key order until fn
+// returns false. Values deleted during the scan are skipped, as are the
+// entries of the table's indexes if the table has no prefix.
+func (t *KVTable[K, M, V]) Scan(fn func(K, V) bool) error {
+	for key, err := range t.kv.Keys(nil, 0) {
+		if err != nil {
+			return err
+		}
+		if len(t.prefix) == 0 && bytes.HasPrefix(key, []byte(kvIndexPrefix)) {
+			continue
+		}
+		value, err := t.kv.Get(key)
+		if errors.Is(err, akcore.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("getting %q: %w", key, err)
+		}
+		k, err := t.keys.DecodeKey(key)
+		if err != nil {
+			return fmt.Errorf("decoding key %q: %w", key, err)
+		}
+		v := V(new(M))
+		if err := v.UnmarshalVT(value); err != nil {
+			return fmt.Errorf("unmarshalling %q: %w", key, err)
+		}
+		if !fn(k, v) {
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+//go:build !wasm
+
+package core_test
+
+import (
+	"bytes"
+	"math"
+	"slices"
+	"testing"
+
+	core "github.com/autonomouskoi/core-tinygo"
+	"github.com/autonomouskoi/core-tinygo/coretest"
+)
+
+func TestInt64Key(t *testing.T) {
+	codec := core.Int64Key{}
+	keys := []int64{math.MinInt64, -1000, -1, 0, 1, 1000, math.MaxInt64}
+	var prev []byte
+	for _, k := range keys {
+		b := codec.EncodeKey(k)
+		if prev != nil && bytes.Compare(prev, b) >= 0 {
+			t.Errorf("%d doesn't sort after the key before it", k)
+		}
+		prev = b
+		if got, err := codec.DecodeKey(b); err != nil || got != k {
+			t.Errorf("got %d, %v, want %d", got, err, k)
+		}
+	}
+	if _, err := codec.DecodeKey([]byte{1, 2, 3}); err == nil {
+		t.Error("decoded a key of the wrong length")
+	}
+}
+
+func TestPairKey(t *testing.T) {
+	codec := core.PairKey[string, string]{First: core.StringKey{}, Second: core.StringKey{}}
+	// in sort order, with zero bytes and terminator lookalikes in the first
+	// part
+	pairs := []core.Pair[string, string]{
+		{First: "", Second: ""},
+		{First: "", Second: "\x00\x01"},
+		{First: "a", Second: ""},
+		{First: "a", Second: "b"},
+		{First: "a\x00", Second: ""},
+		{First: "a\x00\x01", Second: "z"},
+		{First: "a\x00\xff", Second: ""},
+		{First: "a\x01", Second: ""},
+		{First: "ab", Second: "\x00"},
+	}
+	var prev []byte
+	for _, k := range pairs {
+		b := codec.EncodeKey(k)
+		if prev != nil && bytes.Compare(prev, b) >= 0 {
+			t.Errorf("%q doesn't sort after the key before it", k)
+		}
+		prev = b
+		if got, err := codec.DecodeKey(b); err != nil || got != k {
+			t.Errorf("got %q, %v, want %q", got, err, k)
+		}
+	}
+	for _, b := range []string{"a", "a\x00", "a\x00\x02", "a\x00\xff"} {
+		if got, err := codec.DecodeKey([]byte(b)); err == nil {
+			t.Errorf("decoded %q as %q", b, got)
+		}
+	}
+}
+
+func TestKVTablePairKeys(t *testing.T) {
+	coretest.New(t)
+	codec := core.PairKey[string, int64]{First: core.StringKey{}, Second: core.Int64Key{}}
+	table := core.NewKVTable[core.Pair[string, int64], core.KVSetRequest](nil, []byte("t/"), codec)
+	keys := []core.Pair[string, int64]{
+		{First: "a", Second: -1},
+		{First: "a", Second: 2},
+		{First: "a\x00b", Second: 0},
+		{First: "b", Second: math.MinInt64},
+	}
+	for i := len(keys) - 1; i >= 0; i-- {
+		if err := table.Put(keys[i], &core.KVSetRequest{Value: []byte(keys[i].First)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []core.Pair[string, int64]
+	err := table.Scan(func(k core.Pair[string, int64], v *core.KVSetRequest) bool {
+		if string(v.GetValue()) != k.First {
+			t.Errorf("%q: got value %q", k, v.GetValue())
+		}
+		got = append(got, k)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, keys) {
+		t.Errorf("scanned %v, want %v", got, keys)
+	}
+}
@@ -0,0 +1,154 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/autonomouskoi/akcore"
+)
+
+func encodeTTL(expires time.Time, value []byte) []byte {
+	b := kvEnvelopeHeader(kvEnvelopeTTL)
+	b = binary.BigEndian.AppendUint64(b, uint64(expires.UnixMilli()))
+	return append(b, value...)
+}
+
+// decodeTTL returns the value in stored and when it expires. The expiry is
+// zero for values without a TTL.
+func decodeTTL(stored []byte) ([]byte, time.Time, error) {
+	b, ok := cutKVEnvelope(stored, kvEnvelopeTTL)
+	if !ok {
+		return stored, time.Time{}, nil
+	}
+	if len(b) < 8 {
+		return nil, time.Time{}, errors.New("invalid expiry")
+	}
+	return b[8:], time.UnixMilli(int64(binary.BigEndian.Uint64(b))), nil
+}
+
+// SetWithTTL sets key to value, expiring after ttl. Values set this way must
+// be read with GetWithTTL or GetProtoWithTTL.
+func (s *KVStore) SetWithTTL(key, value []byte, ttl time.Duration) error {
+	if err := s.set(key, encodeTTL(s.now().Add(ttl), value)); err != nil {
+		return err
+	}
+	s.publishChange(KVChangeSet, key, value)
+	return nil
+}
+
+// SetProtoWithTTL marshals p and sets key to that value, expiring after ttl.
+func (s *KVStore) SetProtoWithTTL(key []byte, p Marshaller, ttl time.Duration) error {
+	value, err := p.MarshalVT()
+	if err != nil {
+		return err
+	}
+	return s.SetWithTTL(key, value, ttl)
+}
+
+// GetWithTTL retrieves a value set with SetWithTTL. If the value has expired
+// it is deleted and akcore.ErrNotFound is returned. Values set without a TTL
+// are returned as they are.
+func (s *KVStore) GetWithTTL(key []byte) ([]byte, error) {
+	stored, err := s.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	value, expires, err := decodeTTL(stored)
+	if err != nil {
+		return nil, fmt.Errorf("decoding %q: %w", key, err)
+	}
+	if !expires.IsZero() && !s.now().Before(expires) {
+		if err := s.Delete(key); err != nil {
+			return nil, fmt.Errorf("deleting expired %q: %w", key, err)
+		}
+		return nil, akcore.ErrNotFound
+	}
+	return value, nil
+}
+
+// GetProtoWithTTL retrieves a value set with SetWithTTL and unmarshals it into
+// p. See GetWithTTL.
+func (s *KVStore) GetProtoWithTTL(key []byte, p Unmarshaller) error {
+	value, err := s.GetWithTTL(key)
+	if err != nil {
+		return err
+	}
+	return p.UnmarshalVT(value)
+}
+
+// kvSweepCursors tracks where SweepExpired left off for each prefix
+type kvSweepCursors struct {
+	sync.Mutex
+	offsets map[string]int
+}
+
+// SweepExpired examines up to budget keys matching prefix, deleting those with
+// expired values, and returns the number deleted. Each call continues from
+// where the previous call on the KVStore for the same prefix left off,
+// starting over once every key has been examined, so calling it periodically
+// eventually removes every expired value. Values that can't be read, such as
+// those that fail to decode, are logged and skipped. If listing fails, the
+// progress made is kept for the next call.
+func (s *KVStore) SweepExpired(prefix []byte, budget int) (int, error) {
+	cursorKey := string(s.key(prefix))
+	s.sweepCursors.Lock()
+	offset := s.sweepCursors.offsets[cursorKey]
+	s.sweepCursors.Unlock()
+	defer func() {
+		s.sweepCursors.Lock()
+		s.sweepCursors.offsets[cursorKey] = offset
+		s.sweepCursors.Unlock()
+	}()
+	deleted := 0
+	for budget > 0 {
+		resp, err := s.List(prefix, min(budget, DefaultKVPageSize), offset)
+		if err != nil {
+			return deleted, fmt.Errorf("listing: %w", err)
+		}
+		keys := resp.GetKeys()
+		pageDeleted := 0
+		for _, key := range keys {
+			budget--
+			_, err := s.GetWithTTL(key)
+			if errors.Is(err, akcore.ErrNotFound) {
+				// deleted keys no longer count towards the offset
+				pageDeleted++
+				continue
+			}
+			if err != nil {
+				LogWarn("skipping unreadable KV value",
+					"key", string(key),
+					"error", err.Error(),
+				)
+			}
+			offset++
+		}
+		deleted += pageDeleted
+		if len(keys) == 0 || offset >= int(resp.GetTotalMatches())-pageDeleted {
+			offset = 0
+			break
+		}
+	}
+	return deleted, nil
+}
+
+// KVSetWithTTL sets a value in DefaultKV that expires after ttl. See
+// KVStore.SetWithTTL.
+func KVSetWithTTL(key, value []byte, ttl time.Duration) error {
+	return DefaultKV.SetWithTTL(key, value, ttl)
+}
+
+// KVGetWithTTL retrieves a value set with KVSetWithTTL from DefaultKV. See
+// KVStore.GetWithTTL.
+func KVGetWithTTL(key []byte) ([]byte, error) {
+	return DefaultKV.GetWithTTL(key)
+}
+
+// KVSweepExpired deletes expired values from DefaultKV. See
+// KVStore.SweepExpired.
+func KVSweepExpired(prefix []byte, budget int) (int, error) {
+	return DefaultKV.SweepExpired(prefix, budget)
+}
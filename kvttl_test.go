@@ -0,0 +1,88 @@
+//go:build !wasm
+
+package core_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	core "github.com/autonomouskoi/core-tinygo"
+	"github.com/autonomouskoi/core-tinygo/coretest"
+)
+
+func TestKVSweepExpiredCursor(t *testing.T) {
+	h := coretest.New(t)
+	now := time.UnixMilli(1_000_000)
+	kv := core.NewKVStore(core.KVClock(func() time.Time { return now }))
+	// keys 0, 2, 4, 6 and 8 expire, the others don't
+	for i := 0; i < 10; i++ {
+		ttl := time.Hour
+		if i%2 == 0 {
+			ttl = time.Second
+		}
+		if err := kv.SetWithTTL([]byte(fmt.Sprint(i)), nil, ttl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now = now.Add(time.Minute)
+	for _, tc := range []struct {
+		budget      int
+		wantDeleted int
+		wantKeys    int
+	}{
+		// each call continues where the last left off
+		{3, 2, 8},
+		{3, 1, 7},
+		{3, 2, 5},
+		// the cursor wrapped around, finding nothing more to delete
+		{10, 0, 5},
+	} {
+		deleted, err := kv.SweepExpired(nil, tc.budget)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deleted != tc.wantDeleted {
+			t.Errorf("budget %d: deleted %d, want %d", tc.budget, deleted, tc.wantDeleted)
+		}
+		if got := len(h.KVKeys()); got != tc.wantKeys {
+			t.Errorf("budget %d: %d keys left, want %d", tc.budget, got, tc.wantKeys)
+		}
+	}
+}
+
+func TestKVSweepExpiredSkipsBadEntries(t *testing.T) {
+	h := coretest.New(t)
+	now := time.UnixMilli(1_000_000)
+	kv := core.NewKVStore(core.KVClock(func() time.Time { return now }))
+	for _, key := range []string{"a", "c"} {
+		if err := kv.SetWithTTL([]byte(key), nil, time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a TTL envelope too short to hold an expiry
+	h.KVSet([]byte("b"), []byte("\x00akT\x01"))
+	now = now.Add(time.Minute)
+	for _, tc := range []struct {
+		budget      int
+		wantDeleted int
+	}{
+		{2, 1},
+		{2, 1},
+		{2, 0},
+	} {
+		deleted, err := kv.SweepExpired(nil, tc.budget)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deleted != tc.wantDeleted {
+			t.Errorf("deleted %d, want %d", deleted, tc.wantDeleted)
+		}
+	}
+	if keys := h.KVKeys(); len(keys) != 1 || string(keys[0]) != "b" {
+		t.Errorf("got keys %q, want only the bad entry", keys)
+	}
+	if len(h.Logs()) == 0 {
+		t.Error("bad entry not logged")
+	}
+}
@@ -0,0 +1,371 @@
+package core
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/autonomouskoi/akcore"
+)
+
+// ErrKVTxnDone is returned when using a KVTxn that has been committed or
+// discarded.
+var ErrKVTxnDone = errors.New("KV transaction already committed or discarded")
+
+// ErrKVTxnUnfinished is returned, wrapped, by writes to a KVStore with a
+// committed transaction that Commit couldn't finish. RecoverTxns finishes it
+// and allows writes again.
+var ErrKVTxnUnfinished = errors.New("KV transaction unfinished")
+
+// kvTxnState tracks the committed transactions whose writes Commit couldn't
+// finish. It's shared with KVStores created by With.
+type kvTxnState struct {
+	sync.Mutex
+	unfinished map[uint64]struct{}
+}
+
+// checkTxns returns an error if writes to the KVStore are blocked by an
+// unfinished transaction. Writes would otherwise be overwritten when
+// RecoverTxns replays it.
+func (s *KVStore) checkTxns() error {
+	if s.recovering {
+		return nil
+	}
+	s.txns.Lock()
+	defer s.txns.Unlock()
+	if len(s.txns.unfinished) > 0 {
+		return fmt.Errorf("%w: call RecoverTxns", ErrKVTxnUnfinished)
+	}
+	return nil
+}
+
+// recovery returns a copy of the KVStore whose writes aren't blocked by
+// unfinished transactions, for finishing them
+func (s *KVStore) recovery() *KVStore {
+	rs := *s
+	rs.recovering = true
+	return &rs
+}
+
+// kvTxnPrefix starts the keys of transaction journals. A journal's keys are
+// kvTxnPrefix and the transaction's ID, followed by 'c' for the commit marker
+// or by 'e' and an index for each write.
+const kvTxnPrefix = "\x00txn/"
+
+// Journal entries start with the operation
+const (
+	kvTxnOpSet    byte = 'S'
+	kvTxnOpDelete byte = 'D'
+)
+
+func kvTxnCommitKey(id uint64) []byte {
+	return append(binary.BigEndian.AppendUint64([]byte(kvTxnPrefix), id), 'c')
+}
+
+func kvTxnEntryKey(id, index uint64) []byte {
+	b := append(binary.BigEndian.AppendUint64([]byte(kvTxnPrefix), id), 'e')
+	return binary.BigEndian.AppendUint64(b, index)
+}
+
+type kvTxnWrite struct {
+	key     []byte
+	value   []byte
+	deleted bool
+}
+
+func (w *kvTxnWrite) encode() []byte {
+	op := kvTxnOpSet
+	if w.deleted {
+		op = kvTxnOpDelete
+	}
+	b := binary.AppendUvarint([]byte{op}, uint64(len(w.key)))
+	b = append(b, w.key...)
+	return append(b, w.value...)
+}
+
+func decodeKVTxnWrite(b []byte) (*kvTxnWrite, error) {
+	if len(b) == 0 || (b[0] != kvTxnOpSet && b[0] != kvTxnOpDelete) {
+		return nil, errors.New("invalid journal entry")
+	}
+	w := &kvTxnWrite{deleted: b[0] == kvTxnOpDelete}
+	keyLen, n := binary.Uvarint(b[1:])
+	if n <= 0 || uint64(len(b)-1-n) < keyLen {
+		return nil, errors.New("invalid journal entry key")
+	}
+	b = b[1+n:]
+	w.key, w.value = b[:keyLen], b[keyLen:]
+	return w, nil
+}
+
+// apply makes the write to kv
+func (w *kvTxnWrite) apply(kv *KVStore) error {
+	if w.deleted {
+		return kv.Delete(w.key)
+	}
+	return kv.Set(w.key, w.value)
+}
+
+// A KVTxn is a transaction spanning multiple keys. Writes are buffered until
+// Commit, which applies them all or, if the plugin stops partway, leaves a
+// journal that RecoverTxns completes. Reads see the transaction's own writes.
+// Transactions don't isolate reads from other writers; values read aren't
+// checked for changes at Commit.
+type KVTxn struct {
+	kv     *KVStore
+	reads  map[string][]byte
+	writes map[string]*kvTxnWrite
+	order  []string
+	done   bool
+}
+
+// Begin starts a transaction on the KVStore
+func (s *KVStore) Begin() *KVTxn {
+	return &KVTxn{
+		kv:     s,
+		reads:  map[string][]byte{},
+		writes: map[string]*kvTxnWrite{},
+	}
+}
+
+// Get retrieves the value for key as of the transaction's writes. Values read
+// from the KVStore are kept, so reading a key again returns the same value.
+// If there is no value akcore.ErrNotFound is returned.
+func (t *KVTxn) Get(key []byte) ([]byte, error) {
+	if t.done {
+		return nil, ErrKVTxnDone
+	}
+	if w, present := t.writes[string(key)]; present {
+		if w.deleted {
+			return nil, akcore.ErrNotFound
+		}
+		return w.value, nil
+	}
+	value, present := t.reads[string(key)]
+	if !present {
+		var err error
+		value, err = t.kv.Get(key)
+		if errors.Is(err, akcore.ErrNotFound) {
+			value = nil
+		} else if err != nil {
+			return nil, err
+		}
+		t.reads[string(key)] = value
+	}
+	if value == nil {
+		return nil, akcore.ErrNotFound
+	}
+	return value, nil
+}
+
+// GetProto retrieves the value for key as of the transaction's writes and
+// unmarshals it into p.
+func (t *KVTxn) GetProto(key []byte, p Unmarshaller) error {
+	value, err := t.Get(key)
+	if err != nil {
+		return err
+	}
+	return p.UnmarshalVT(value)
+}
+
+func (t *KVTxn) write(w *kvTxnWrite) error {
+	if t.done {
+		return ErrKVTxnDone
+	}
+	if _, present := t.writes[string(w.key)]; !present {
+		t.order = append(t.order, string(w.key))
+	}
+	t.writes[string(w.key)] = w
+	return nil
+}
+
+// Set buffers setting key to value until Commit
+func (t *KVTxn) Set(key, value []byte) error {
+	return t.write(&kvTxnWrite{
+		key:   bytes.Clone(key),
+		value: bytes.Clone(value),
+	})
+}
+
+// SetProto marshals p and buffers setting key to that value until Commit
+func (t *KVTxn) SetProto(key []byte, p Marshaller) error {
+	value, err := p.MarshalVT()
+	if err != nil {
+		return err
+	}
+	return t.Set(key, value)
+}
+
+// Delete buffers deleting key until Commit
+func (t *KVTxn) Delete(key []byte) error {
+	return t.write(&kvTxnWrite{key: bytes.Clone(key), deleted: true})
+}
+
+// Commit applies the transaction's writes. The writes are first recorded in a
+// journal, then a commit marker is set and the writes are applied in the
+// order their keys were first written. If the plugin stops before the marker
+// is set, RecoverTxns discards the journal and none of the writes are
+// applied; after, RecoverTxns applies them all. If applying the writes fails
+// after the marker is set, Commit tries once more. If that fails too, it
+// returns ErrKVTxnUnfinished and further writes to the KVStore fail with
+// ErrKVTxnUnfinished until RecoverTxns applies them.
+func (t *KVTxn) Commit() error {
+	if t.done {
+		return ErrKVTxnDone
+	}
+	t.done = true
+	if len(t.order) == 0 {
+		return nil
+	}
+	var idBytes [8]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return fmt.Errorf("generating ID: %w", err)
+	}
+	id := binary.BigEndian.Uint64(idBytes[:])
+	for i, key := range t.order {
+		if err := t.kv.set(kvTxnEntryKey(id, uint64(i)), t.writes[key].encode()); err != nil {
+			// the journal is incomplete without the marker, so it's
+			// discarded by RecoverTxns
+			return fmt.Errorf("journaling %q: %w", key, err)
+		}
+	}
+	if err := t.kv.set(kvTxnCommitKey(id), binary.AppendUvarint(nil, uint64(len(t.order)))); err != nil {
+		return fmt.Errorf("setting commit marker: %w", err)
+	}
+	writes := make([]*kvTxnWrite, len(t.order))
+	for i, key := range t.order {
+		writes[i] = t.writes[key]
+	}
+	err := t.kv.applyTxn(id, writes)
+	if err == nil {
+		return nil
+	}
+	// try once more, then block writes so they aren't overwritten when
+	// RecoverTxns replays the journal
+	if retryErr := t.kv.recovery().applyTxn(id, writes); retryErr != nil {
+		t.kv.txns.Lock()
+		t.kv.txns.unfinished[id] = struct{}{}
+		t.kv.txns.Unlock()
+		return fmt.Errorf("%w: %w", ErrKVTxnUnfinished, err)
+	}
+	return nil
+}
+
+// applyTxn applies the writes of the committed transaction id and deletes its
+// journal
+func (s *KVStore) applyTxn(id uint64, writes []*kvTxnWrite) error {
+	for _, w := range writes {
+		if err := w.apply(s); err != nil {
+			return fmt.Errorf("applying %q: %w", w.key, err)
+		}
+	}
+	return s.deleteJournal(id, len(writes))
+}
+
+// Discard abandons the transaction's writes
+func (t *KVTxn) Discard() {
+	t.done = true
+}
+
+// deleteJournal deletes the commit marker and then the entries of a journal
+func (s *KVStore) deleteJournal(id uint64, entries int) error {
+	if err := s.remove(kvTxnCommitKey(id)); err != nil {
+		return fmt.Errorf("deleting commit marker: %w", err)
+	}
+	for i := 0; i < entries; i++ {
+		if err := s.remove(kvTxnEntryKey(id, uint64(i))); err != nil {
+			return fmt.Errorf("deleting journal entry %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// RecoverTxns completes the transactions interrupted during Commit, returning
+// the number of transactions replayed. Journals with a commit marker are
+// replayed; those without are discarded, rolling the transaction back. It
+// should be called at start, before the KVStore is otherwise used, and after
+// Commit returns ErrKVTxnUnfinished, with the KVStore the transactions were
+// begun on. Start calls it for the KVStores of a Module that is a
+// TxnRecoverer.
+func (s *KVStore) RecoverTxns() (int, error) {
+	rs := s.recovery()
+	entries := map[uint64]int{}
+	committed := map[uint64]uint64{}
+	for key, err := range s.Keys([]byte(kvTxnPrefix), 0) {
+		if err != nil {
+			return 0, err
+		}
+		rest := key[len(kvTxnPrefix):]
+		if len(rest) < 9 {
+			return 0, fmt.Errorf("invalid journal key %q", key)
+		}
+		id := binary.BigEndian.Uint64(rest)
+		switch {
+		case rest[8] == 'e' && len(rest) == 17:
+			entries[id] = max(entries[id], int(binary.BigEndian.Uint64(rest[9:]))+1)
+		case rest[8] == 'c' && len(rest) == 9:
+			b, err := s.Get(key)
+			if err != nil {
+				return 0, fmt.Errorf("getting commit marker: %w", err)
+			}
+			count, n := binary.Uvarint(b)
+			if n <= 0 {
+				return 0, fmt.Errorf("invalid commit marker %q", key)
+			}
+			committed[id] = count
+		default:
+			return 0, fmt.Errorf("invalid journal key %q", key)
+		}
+	}
+	ids := make([]uint64, 0, len(entries))
+	for id := range entries {
+		ids = append(ids, id)
+	}
+	for id := range committed {
+		if _, present := entries[id]; !present {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	replayed := 0
+	for _, id := range ids {
+		count, ok := committed[id]
+		if !ok {
+			LogInfo("discarding uncommitted KV transaction", "entries", int64(entries[id]))
+			if err := rs.deleteJournal(id, entries[id]); err != nil {
+				return replayed, err
+			}
+			continue
+		}
+		LogInfo("replaying KV transaction", "entries", int64(count))
+		for i := uint64(0); i < count; i++ {
+			b, err := s.Get(kvTxnEntryKey(id, i))
+			if err != nil {
+				return replayed, fmt.Errorf("getting journal entry %d: %w", i, err)
+			}
+			w, err := decodeKVTxnWrite(b)
+			if err != nil {
+				return replayed, err
+			}
+			if err := w.apply(rs); err != nil {
+				return replayed, fmt.Errorf("applying %q: %w", w.key, err)
+			}
+		}
+		if err := rs.deleteJournal(id, int(count)); err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+	s.txns.Lock()
+	clear(s.txns.unfinished)
+	s.txns.Unlock()
+	return replayed, nil
+}
+
+// KVBegin starts a transaction on DefaultKV. See KVStore.Begin.
+func KVBegin() *KVTxn {
+	return DefaultKV.Begin()
+}
@@ -0,0 +1,91 @@
+//go:build !wasm
+
+package core_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	core "github.com/autonomouskoi/core-tinygo"
+)
+
+func TestKVTxnRecovery(t *testing.T) {
+	// committing sets two journal entries, the commit marker, then a and b.
+	// If applying fails, Commit applies a and b once more.
+	for _, tc := range []struct {
+		name         string
+		failSet      int
+		failCount    int
+		wantErr      bool
+		wantReplayed int
+		wantA, wantB string
+	}{
+		{"journal incomplete", 2, 1, true, 0, "old a", ""},
+		{"no commit marker", 3, 1, true, 0, "old a", ""},
+		{"apply retried", 5, 1, false, 0, "new a", "new b"},
+		{"unfinished", 5, 2, true, 1, "new a", "new b"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newFailingHost(t, 0)
+			h.KVSet([]byte("a"), []byte("old a"))
+			h.failSet, h.failCount = tc.failSet, tc.failCount
+			txn := core.DefaultKV.Begin()
+			if err := txn.Set([]byte("a"), []byte("new a")); err != nil {
+				t.Fatal(err)
+			}
+			if err := txn.Set([]byte("b"), []byte("new b")); err != nil {
+				t.Fatal(err)
+			}
+			if err := txn.Commit(); (err != nil) != tc.wantErr {
+				t.Fatalf("got commit error %v", err)
+			}
+			replayed, err := core.DefaultKV.RecoverTxns()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if replayed != tc.wantReplayed {
+				t.Errorf("replayed %d, want %d", replayed, tc.wantReplayed)
+			}
+			for key, want := range map[string]string{"a": tc.wantA, "b": tc.wantB} {
+				if got, _ := h.KVGet([]byte(key)); string(got) != want {
+					t.Errorf("%s: got %q, want %q", key, got, want)
+				}
+			}
+			for _, key := range h.KVKeys() {
+				if bytes.HasPrefix(key, []byte("\x00txn/")) {
+					t.Errorf("journal key %q left behind", key)
+				}
+			}
+		})
+	}
+}
+
+func TestKVTxnUnfinishedBlocksWrites(t *testing.T) {
+	h := newFailingHost(t, 0)
+	txn := core.DefaultKV.Begin()
+	if err := txn.Set([]byte("a"), []byte("txn")); err != nil {
+		t.Fatal(err)
+	}
+	// the journal entry, the commit marker, then both attempts to apply
+	h.failSet, h.failCount = 3, 2
+	if err := txn.Commit(); !errors.Is(err, core.ErrKVTxnUnfinished) {
+		t.Fatalf("got commit error %v, want ErrKVTxnUnfinished", err)
+	}
+	// a write now would be overwritten when the journal is replayed
+	ns := core.DefaultKV.With(core.KVNamespace([]byte("ns/")))
+	for _, kv := range []*core.KVStore{core.DefaultKV, ns} {
+		if err := kv.Set([]byte("a"), []byte("later")); !errors.Is(err, core.ErrKVTxnUnfinished) {
+			t.Fatalf("got set error %v, want ErrKVTxnUnfinished", err)
+		}
+	}
+	if replayed, err := core.DefaultKV.RecoverTxns(); err != nil || replayed != 1 {
+		t.Fatalf("got %d, %v from RecoverTxns, want 1", replayed, err)
+	}
+	if err := core.DefaultKV.Set([]byte("a"), []byte("later")); err != nil {
+		t.Fatalf("set after recovery: %v", err)
+	}
+	if got, _ := h.KVGet([]byte("a")); string(got) != "later" {
+		t.Errorf("got %q, want %q", got, "later")
+	}
+}
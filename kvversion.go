@@ -0,0 +1,129 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/autonomouskoi/akcore"
+)
+
+// The host has no compare-and-set request yet, so CompareAndSet is a Get
+// followed by a Set. Handlers in a plugin run one at a time, so nothing else
+// in the plugin can write between them, but another plugin writing the same
+// key can. The proposed additions to bus.proto, numbered after the batch
+// requests in kvbatch.go, are:
+//
+//	KV_COMPARE_AND_SET_REQ  = 27; // KVCompareAndSetRequest { bytes key = 1; bytes expected = 2; bool expect_absent = 3; bytes value = 4; }
+//	KV_COMPARE_AND_SET_RESP = 28; // KVCompareAndSetResponse { bool swapped = 1; bytes current = 2; }
+//
+// The host would compare the stored bytes, envelope included, with expected
+// and set value only if they match, atomically with respect to other
+// plugins. Once the host supports it, CompareAndSet should send the stored
+// value it read as expected and fall back to the current implementation if
+// the host replies with an error or times out.
+
+// ErrKVConflict is returned by CompareAndSet when the stored revision doesn't
+// match the expected revision.
+var ErrKVConflict = errors.New("KV revision conflict")
+
+// KVUpdateAttempts is the number of times Update tries to apply its function
+// before giving up with ErrKVConflict.
+const KVUpdateAttempts = 5
+
+func encodeVersioned(revision uint64, value []byte) []byte {
+	b := kvEnvelopeHeader(kvEnvelopeVersioned)
+	b = binary.AppendUvarint(b, revision)
+	return append(b, value...)
+}
+
+func decodeVersioned(stored []byte) ([]byte, uint64, error) {
+	b, ok := cutKVEnvelope(stored, kvEnvelopeVersioned)
+	if !ok {
+		return stored, 0, nil
+	}
+	revision, n := binary.Uvarint(b)
+	if n <= 0 {
+		return nil, 0, errors.New("invalid revision")
+	}
+	return b[n:], revision, nil
+}
+
+// GetVersioned retrieves the value for key and its revision. Values not
+// written with CompareAndSet have revision 0, including values that were
+// written with CompareAndSet and then overwritten with Set. If there's no
+// value for key, akcore.ErrNotFound is returned.
+func (s *KVStore) GetVersioned(key []byte) ([]byte, uint64, error) {
+	stored, err := s.Get(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return decodeVersioned(stored)
+}
+
+// CompareAndSet sets key to value if its current revision is
+// expectedRevision, returning the new revision. An expectedRevision of 0
+// matches a key with no value. If the revision doesn't match, ErrKVConflict is
+// returned.
+//
+// The check and set are separate requests to the host, so CompareAndSet only
+// protects against writes made from within this plugin, not against other
+// plugins writing the same key. Revisions only count writes made with
+// CompareAndSet: a plain Set resets the revision to 0, so a caller expecting
+// 0 can't tell a key that was never versioned from one that was reset.
+func (s *KVStore) CompareAndSet(key []byte, expectedRevision uint64, value []byte) (uint64, error) {
+	_, revision, err := s.GetVersioned(key)
+	if err != nil && !errors.Is(err, akcore.ErrNotFound) {
+		return 0, fmt.Errorf("getting current revision: %w", err)
+	}
+	if revision != expectedRevision {
+		return revision, ErrKVConflict
+	}
+	revision++
+	if err := s.set(key, encodeVersioned(revision, value)); err != nil {
+		return 0, err
+	}
+	s.publishChange(KVChangeSet, key, value)
+	return revision, nil
+}
+
+// Update replaces the value for key with the result of calling fn with the
+// current value, using CompareAndSet. The current value is nil if there is
+// none. If the revision changes before the new value is set, such as when fn
+// itself writes key, fn is called again with the new value, up to
+// KVUpdateAttempts times. An error returned by fn is returned without setting
+// a value. Update has the same in-plugin scope as CompareAndSet.
+func (s *KVStore) Update(key []byte, fn func(old []byte) ([]byte, error)) error {
+	for attempt := 0; attempt < KVUpdateAttempts; attempt++ {
+		old, revision, err := s.GetVersioned(key)
+		if err != nil && !errors.Is(err, akcore.ErrNotFound) {
+			return err
+		}
+		value, err := fn(old)
+		if err != nil {
+			return err
+		}
+		_, err = s.CompareAndSet(key, revision, value)
+		if !errors.Is(err, ErrKVConflict) {
+			return err
+		}
+	}
+	return ErrKVConflict
+}
+
+// KVGetVersioned retrieves a value and its revision from DefaultKV. See
+// KVStore.GetVersioned.
+func KVGetVersioned(key []byte) ([]byte, uint64, error) {
+	return DefaultKV.GetVersioned(key)
+}
+
+// KVCompareAndSet sets a value in DefaultKV if its revision matches. See
+// KVStore.CompareAndSet.
+func KVCompareAndSet(key []byte, expectedRevision uint64, value []byte) (uint64, error) {
+	return DefaultKV.CompareAndSet(key, expectedRevision, value)
+}
+
+// KVUpdate updates a value in DefaultKV. See KVStore.Update.
+func KVUpdate(key []byte, fn func(old []byte) ([]byte, error)) error {
+	return DefaultKV.Update(key, fn)
+}
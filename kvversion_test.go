@@ -0,0 +1,96 @@
+//go:build !wasm
+
+package core_test
+
+import (
+	"errors"
+	"testing"
+
+	core "github.com/autonomouskoi/core-tinygo"
+	"github.com/autonomouskoi/core-tinygo/coretest"
+)
+
+func TestKVCompareAndSet(t *testing.T) {
+	coretest.New(t)
+	kv := core.NewKVStore()
+	key := []byte("k")
+	for _, tc := range []struct {
+		name     string
+		expected uint64
+		want     uint64
+		wantErr  error
+	}{
+		{"create", 0, 1, nil},
+		{"stale", 0, 1, core.ErrKVConflict},
+		{"update", 1, 2, nil},
+	} {
+		got, err := kv.CompareAndSet(key, tc.expected, []byte(tc.name))
+		if !errors.Is(err, tc.wantErr) || got != tc.want {
+			t.Fatalf("%s: got %d, %v, want %d, %v", tc.name, got, err, tc.want, tc.wantErr)
+		}
+	}
+	// a plain Set resets the revision
+	if err := kv.Set(key, []byte("plain")); err != nil {
+		t.Fatal(err)
+	}
+	if _, revision, err := kv.GetVersioned(key); err != nil || revision != 0 {
+		t.Fatalf("got revision %d, %v after Set, want 0", revision, err)
+	}
+}
+
+func TestKVUpdate(t *testing.T) {
+	coretest.New(t)
+	kv := core.NewKVStore()
+	key := []byte("k")
+	for _, tc := range []struct {
+		name    string
+		fn      func(old []byte) ([]byte, error)
+		want    string
+		wantErr bool
+	}{
+		{"append", func(old []byte) ([]byte, error) { return append(old, 'a'), nil }, "a", false},
+		{"append again", func(old []byte) ([]byte, error) { return append(old, 'b'), nil }, "ab", false},
+		{"fn error", func(old []byte) ([]byte, error) { return nil, errors.New("nope") }, "ab", true},
+		{"conflict retried", func() func([]byte) ([]byte, error) {
+			calls := 0
+			return func(old []byte) ([]byte, error) {
+				calls++
+				if calls == 1 {
+					// a write between reading and setting causes a conflict
+					if _, err := kv.CompareAndSet(key, 2, []byte("inner")); err != nil {
+						return nil, err
+					}
+				}
+				return append(old, '!'), nil
+			}
+		}(), "inner!", false},
+	} {
+		err := kv.Update(key, tc.fn)
+		if (err != nil) != tc.wantErr {
+			t.Fatalf("%s: got error %v", tc.name, err)
+		}
+		got, _, err := kv.GetVersioned(key)
+		if err != nil || string(got) != tc.want {
+			t.Fatalf("%s: got %q, %v, want %q", tc.name, got, err, tc.want)
+		}
+	}
+}
+
+func TestKVUpdateGivesUp(t *testing.T) {
+	coretest.New(t)
+	kv := core.NewKVStore()
+	key := []byte("k")
+	calls := 0
+	err := kv.Update(key, func(old []byte) ([]byte, error) {
+		calls++
+		_, revision, _ := kv.GetVersioned(key)
+		_, err := kv.CompareAndSet(key, revision, []byte("inner"))
+		return []byte("outer"), err
+	})
+	if !errors.Is(err, core.ErrKVConflict) {
+		t.Fatalf("got %v, want ErrKVConflict", err)
+	}
+	if calls != core.KVUpdateAttempts {
+		t.Errorf("fn called %d times, want %d", calls, core.KVUpdateAttempts)
+	}
+}
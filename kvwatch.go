@@ -0,0 +1,146 @@
+package core
+
+import (
+	"bytes"
+)
+
+// The BusMessage types of KV change events published by a KVStore with
+// KVWatch. A KVChangeSet message carries a KVSetRequest and a KVChangeDelete
+// message carries a KVDeleteRequest.
+const (
+	KVChangeSet    int32 = 1
+	KVChangeDelete int32 = 2
+)
+
+// KVWatch makes the KVStore publish a change event on topic with Send after
+// each successful change made through its public API: Set, SetProto,
+// SetWithTTL, CompareAndSet, SetChunked, their Delete counterparts, and
+// values expiring on read. Events carry the key the caller used, with the
+// namespace, and never the internal keys used for chunks, indexes, queues,
+// transaction journals or schema state. If includeValues is true, set events
+// carry the value as the caller passed it, without TTL, revision or chunk
+// envelopes and before compression. A KVStore with KVEncrypt never includes
+// values, so they aren't broadcast in plaintext. A failure to publish is
+// logged rather than failing the change.
+func KVWatch(topic string, includeValues bool) KVOption {
+	return func(s *KVStore) {
+		s.watchTopic = topic
+		s.watchValues = includeValues
+	}
+}
+
+// publishChange sends a change event if the KVStore is watched. msgType is
+// KVChangeSet or KVChangeDelete.
+func (s *KVStore) publishChange(msgType int32, key, value []byte) {
+	if s.watchTopic == "" {
+		return
+	}
+	msg := &BusMessage{
+		Topic: s.watchTopic,
+		Type:  msgType,
+	}
+	if msgType == KVChangeDelete {
+		MarshalMessage(msg, &KVDeleteRequest{Key: s.key(key)})
+	} else {
+		req := &KVSetRequest{Key: s.key(key)}
+		if s.watchValues && s.keyring == nil {
+			req.Value = value
+		}
+		MarshalMessage(msg, req)
+	}
+	if msg.Error != nil {
+		// MarshalMessage logged the failure
+		return
+	}
+	if err := Send(msg); err != nil {
+		LogError("publishing KV change",
+			"topic", s.watchTopic,
+			"key", string(s.key(key)),
+			"error", err.Error(),
+		)
+	}
+}
+
+// A KVChange is a change event published by a KVStore with KVWatch
+type KVChange struct {
+	// Key is the full key, including any namespace
+	Key []byte
+	// Value is the new value, if the KVStore includes values
+	Value   []byte
+	Deleted bool
+}
+
+// A KVChangeFunc is called with KV change events
+type KVChangeFunc func(*KVChange)
+
+type kvWatch struct {
+	prefix []byte
+	fn     KVChangeFunc
+}
+
+// A KVWatcher dispatches the change events published on a topic to callbacks
+// by key prefix.
+type KVWatcher struct {
+	topic   string
+	watches []kvWatch
+}
+
+// NewKVWatcher creates a KVWatcher for the change events published on topic
+func NewKVWatcher(topic string) *KVWatcher {
+	return &KVWatcher{topic: topic}
+}
+
+// OnPrefix calls fn with the change events for keys starting with prefix.
+// Callbacks are called in the order they were added.
+func (w *KVWatcher) OnPrefix(prefix []byte, fn KVChangeFunc) {
+	w.watches = append(w.watches, kvWatch{prefix: bytes.Clone(prefix), fn: fn})
+}
+
+// Subscribe subscribes to the KVWatcher's topic. This isn't necessary if the
+// topic is in the Routes of the registered Module, which are subscribed by
+// Start.
+func (w *KVWatcher) Subscribe() error {
+	return Subscribe(w.topic)
+}
+
+// Topic returns the topic the KVWatcher's events are published on
+func (w *KVWatcher) Topic() string {
+	return w.topic
+}
+
+// Routes returns a TypeRouter dispatching change events to the KVWatcher, to
+// be added to a TopicRouter with the KVWatcher's topic.
+func (w *KVWatcher) Routes() TypeRouter {
+	return TypeRouter{
+		KVChangeSet:    w.Handle,
+		KVChangeDelete: w.Handle,
+	}
+}
+
+// Handle dispatches a change event to the matching callbacks. Messages that
+// aren't change events are ignored. It never returns a reply.
+func (w *KVWatcher) Handle(msg *BusMessage) *BusMessage {
+	change := &KVChange{}
+	switch msg.GetType() {
+	case KVChangeSet:
+		req := &KVSetRequest{}
+		if UnmarshalMessage(msg, req) != nil {
+			return nil
+		}
+		change.Key, change.Value = req.GetKey(), req.GetValue()
+	case KVChangeDelete:
+		req := &KVDeleteRequest{}
+		if UnmarshalMessage(msg, req) != nil {
+			return nil
+		}
+		change.Key, change.Deleted = req.GetKey(), true
+	default:
+		return nil
+	}
+	for _, watch := range w.watches {
+		if bytes.HasPrefix(change.Key, watch.prefix) {
+			watch.fn(change)
+		}
+	}
+	return nil
+}
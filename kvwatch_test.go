@@ -0,0 +1,137 @@
+//go:build !wasm
+
+package core_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	core "github.com/autonomouskoi/core-tinygo"
+	"github.com/autonomouskoi/core-tinygo/coretest"
+)
+
+func TestKVWatchLogicalChanges(t *testing.T) {
+	big := bytes.Repeat([]byte("x"), 10)
+	for _, tc := range []struct {
+		name   string
+		change func(kv *core.KVStore) error
+		want   []core.KVChange
+	}{
+		{"set", func(kv *core.KVStore) error {
+			return kv.Set([]byte("k"), []byte("v"))
+		}, []core.KVChange{{Key: []byte("ns/k"), Value: []byte("v")}}},
+		{"ttl", func(kv *core.KVStore) error {
+			return kv.SetWithTTL([]byte("k"), []byte("v"), time.Minute)
+		}, []core.KVChange{{Key: []byte("ns/k"), Value: []byte("v")}}},
+		{"compare and set", func(kv *core.KVStore) error {
+			_, err := kv.CompareAndSet([]byte("k"), 0, []byte("v"))
+			return err
+		}, []core.KVChange{{Key: []byte("ns/k"), Value: []byte("v")}}},
+		{"chunked", func(kv *core.KVStore) error {
+			if err := kv.SetChunked([]byte("k"), big, 4); err != nil {
+				return err
+			}
+			return kv.DeleteChunked([]byte("k"))
+		}, []core.KVChange{
+			{Key: []byte("ns/k"), Value: big},
+			{Key: []byte("ns/k"), Deleted: true},
+		}},
+		{"queue", func(kv *core.KVStore) error {
+			q := core.NewKVQueue(kv, []byte("q/"))
+			if _, err := q.Enqueue([]byte("v")); err != nil {
+				return err
+			}
+			item, err := q.Dequeue()
+			if err != nil {
+				return err
+			}
+			return q.Ack(item)
+		}, nil},
+		{"txn", func(kv *core.KVStore) error {
+			txn := kv.Begin()
+			if err := txn.Set([]byte("a"), []byte("1")); err != nil {
+				return err
+			}
+			if err := txn.Delete([]byte("b")); err != nil {
+				return err
+			}
+			return txn.Commit()
+		}, []core.KVChange{
+			{Key: []byte("ns/a"), Value: []byte("1")},
+			{Key: []byte("ns/b"), Deleted: true},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := coretest.New(t)
+			kv := core.NewKVStore(
+				core.KVNamespace([]byte("ns/")),
+				core.KVCompress(1),
+				core.KVWatch("changes", true),
+			)
+			var got []core.KVChange
+			watcher := core.NewKVWatcher("changes")
+			watcher.OnPrefix(nil, func(change *core.KVChange) {
+				got = append(got, *change)
+			})
+			if err := tc.change(kv); err != nil {
+				t.Fatal(err)
+			}
+			for _, msg := range h.SentTo("changes") {
+				watcher.Handle(msg)
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %d changes, want %d: %+v", len(got), len(tc.want), got)
+			}
+			for i, want := range tc.want {
+				if !bytes.Equal(got[i].Key, want.Key) || !bytes.Equal(got[i].Value, want.Value) ||
+					got[i].Deleted != want.Deleted {
+					t.Errorf("change %d: got %+v, want %+v", i, got[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestKVWatchExpiry(t *testing.T) {
+	h := coretest.New(t)
+	now := time.UnixMilli(1_000_000)
+	kv := core.NewKVStore(
+		core.KVClock(func() time.Time { return now }),
+		core.KVWatch("changes", false),
+	)
+	if err := kv.SetWithTTL([]byte("k"), []byte("v"), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Second)
+	if _, err := kv.GetWithTTL([]byte("k")); err == nil {
+		t.Fatal("expired value returned")
+	}
+	sent := h.SentTo("changes")
+	if len(sent) != 2 || sent[1].GetType() != core.KVChangeDelete {
+		t.Fatalf("got %d events, want a set and a delete", len(sent))
+	}
+}
+
+func TestKVWatchEncrypted(t *testing.T) {
+	h := coretest.New(t)
+	keyring, err := core.NewKVKeyring(1, bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := core.NewKVStore(core.KVEncrypt(keyring), core.KVWatch("changes", true))
+	if err := kv.Set([]byte("k"), []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	var got []core.KVChange
+	watcher := core.NewKVWatcher("changes")
+	watcher.OnPrefix(nil, func(change *core.KVChange) {
+		got = append(got, *change)
+	})
+	for _, msg := range h.SentTo("changes") {
+		watcher.Handle(msg)
+	}
+	if len(got) != 1 || string(got[0].Key) != "k" || got[0].Value != nil {
+		t.Fatalf("got changes %+v, want the key without its value", got)
+	}
+}
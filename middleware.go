@@ -0,0 +1,90 @@
+package core
+
+import (
+	"time"
+)
+
+// A Middleware wraps a Handler to add behavior around it. A middleware can
+// short-circuit handling by returning a reply, such as one from ErrorReply,
+// without calling next.
+type Middleware func(next Handler) Handler
+
+// Chain combines mws into a single Middleware. The first middleware is the
+// outermost, seeing the message first and the reply last.
+func Chain(mws ...Middleware) Middleware {
+	return func(next Handler) Handler {
+		for i := len(mws) - 1; i >= 0; i-- {
+			next = mws[i](next)
+		}
+		return next
+	}
+}
+
+// Use wraps every handler currently in r with mws, the first being the
+// outermost. Handlers added to r later are not wrapped, so Use should be called
+// after all handlers are registered. Each call to Use wraps outside the
+// middlewares from previous calls.
+func (r TypeRouter) Use(mws ...Middleware) {
+	mw := Chain(mws...)
+	for msgType, handler := range r {
+		r[msgType] = mw(handler)
+	}
+}
+
+// Use calls Use with mws on every TypeRouter in r. Calling this after Use on
+// the individual TypeRouters places these middlewares outside of theirs.
+func (r TopicRouter) Use(mws ...Middleware) {
+	for _, tr := range r {
+		tr.Use(mws...)
+	}
+}
+
+// ErrorReply creates a reply to msg with DefaultReply and sets its Error.
+func ErrorReply(msg *BusMessage, code CommonErrorCode, detail string) *BusMessage {
+	reply := DefaultReply(msg)
+	reply.Error = &Error{
+		Code:   int32(code),
+		Detail: &detail,
+	}
+	return reply
+}
+
+// LogMessages is a Middleware that logs the topic, type, and sending module
+// of each message at the given level, along with how long handling took.
+func LogMessages(level LogLevel) Middleware {
+	return func(next Handler) Handler {
+		return func(msg *BusMessage) *BusMessage {
+			start := time.Now()
+			reply := next(msg)
+			Log(level, "handled message",
+				"topic", msg.GetTopic(),
+				"type", msg.GetType(),
+				"from_mod", msg.GetFromMod(),
+				"duration_ms", time.Since(start).Milliseconds(),
+			)
+			return reply
+		}
+	}
+}
+
+// AllowFromMod is a Middleware that only passes messages sent by one of the
+// named modules to the handler. Other messages are dropped, with a
+// CommonErrorCode_UNKNOWN reply if they have a ReplyTo.
+func AllowFromMod(mods ...string) Middleware {
+	allowed := make(map[string]bool, len(mods))
+	for _, mod := range mods {
+		allowed[mod] = true
+	}
+	return func(next Handler) Handler {
+		return func(msg *BusMessage) *BusMessage {
+			if !allowed[msg.GetFromMod()] {
+				if msg.ReplyTo == nil {
+					return nil
+				}
+				return ErrorReply(msg, CommonErrorCode_UNKNOWN,
+					"module not allowed: "+msg.GetFromMod())
+			}
+			return next(msg)
+		}
+	}
+}
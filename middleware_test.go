@@ -0,0 +1,65 @@
+//go:build !wasm
+
+package core_test
+
+import (
+	"testing"
+
+	core "github.com/autonomouskoi/core-tinygo"
+	"github.com/autonomouskoi/core-tinygo/coretest"
+)
+
+func TestAllowFromMod(t *testing.T) {
+	replyTo := int64(7)
+	for _, tc := range []struct {
+		name      string
+		fromMod   string
+		replyTo   *int64
+		handled   bool
+		wantReply bool
+		wantCode  int32
+	}{
+		{"allowed request", "friend", &replyTo, true, true, 0},
+		{"allowed event", "friend", nil, true, false, 0},
+		{"rejected request", "stranger", &replyTo, false, true, int32(core.CommonErrorCode_UNKNOWN)},
+		{"rejected event", "stranger", nil, false, false, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := coretest.New(t)
+			handled := false
+			tr := core.TypeRouter{1: func(msg *core.BusMessage) *core.BusMessage {
+				handled = true
+				if msg.ReplyTo == nil {
+					return nil
+				}
+				return core.DefaultReply(msg)
+			}}
+			tr.Use(core.AllowFromMod("friend"))
+			core.TopicRouter{"topic": tr}.Handle(&core.BusMessage{
+				Topic:   "topic",
+				Type:    1,
+				FromMod: tc.fromMod,
+				ReplyTo: tc.replyTo,
+			})
+			if handled != tc.handled {
+				t.Errorf("handled %v, want %v", handled, tc.handled)
+			}
+			replies := h.Replies()
+			if !tc.wantReply {
+				if len(replies) != 0 {
+					t.Fatalf("got %d replies, want none", len(replies))
+				}
+				return
+			}
+			if len(replies) != 1 {
+				t.Fatalf("got %d replies, want 1", len(replies))
+			}
+			if got := replies[0].GetError().GetCode(); got != tc.wantCode {
+				t.Errorf("got error code %d, want %d", got, tc.wantCode)
+			}
+			if replies[0].GetReplyTo() != replyTo {
+				t.Errorf("got ReplyTo %d, want %d", replies[0].GetReplyTo(), replyTo)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package core
+
+import (
+	"sort"
+)
+
+// A Module is a plugin built on the core package. Register the module with
+// Register and import the export package to provide the start and recv
+// exports the host calls.
+type Module interface {
+	// Init is called once when the host starts the plugin
+	Init() error
+	// Routes is called after Init. The plugin is subscribed to each topic in
+	// the returned router and received messages are dispatched through it,
+	// compiled once with TopicRouter.Compile. Topic patterns can't be
+	// subscribed to, the Module must subscribe to the topics they should
+	// match itself.
+	Routes() TopicRouter
+}
+
+// A Migrator is a Module with KV migrations. Start runs them before calling
+// Init.
+type Migrator interface {
+	Migrations() *KVMigrator
+}
+
+// A TxnRecoverer is a Module using KV transactions. Start recovers the
+// transactions interrupted in its KVStores before running migrations.
+type TxnRecoverer interface {
+	TxnStores() []*KVStore
+}
+
+// A Fallbacker is a Module with a handler for messages its routes don't
+// handle. Start sets it as the Fallback of the Module's Router.
+type Fallbacker interface {
+	Fallback() Handler
+}
+
+// A Shutdowner is a Module that needs to clean up when the host stops it.
+type Shutdowner interface {
+	Shutdown() error
+}
+
+// Return codes for the functions exported to the host
+const (
+	ReturnOK int32 = iota
+	ReturnNoModule
+	ReturnInitFailed
+	ReturnSubscribeFailed
+	ReturnDecodeFailed
+	ReturnShutdownFailed
+	ReturnMigrationFailed
+	ReturnTxnRecoveryFailed
+	ReturnHandlerPanicked
+)
+
+var (
+	module Module
+	routes *Router
+)
+
+// Register sets the Module used by Start, Dispatch, and Shutdown. It's
+// typically called from the plugin's init function.
+func Register(m Module) {
+	module = m
+}
+
+// Start initializes the registered Module and subscribes to the topics it
+// routes. If the Module is a TxnRecoverer, interrupted KV transactions are
+// recovered first, then if it's a Migrator, its migrations are run. It
+// implements the start export.
+func Start() int32 {
+	if module == nil {
+		return ReturnNoModule
+	}
+	if m, ok := module.(TxnRecoverer); ok {
+		for _, kv := range m.TxnStores() {
+			if _, err := kv.RecoverTxns(); err != nil {
+				LogError("recovering KV transactions", "error", err.Error())
+				return ReturnTxnRecoveryFailed
+			}
+		}
+	}
+	if m, ok := module.(Migrator); ok {
+		if err := m.Migrations().Run(); err != nil {
+			LogError("migrating KV", "error", err.Error())
+			return ReturnMigrationFailed
+		}
+	}
+	if err := module.Init(); err != nil {
+		LogError("initializing module", "error", err.Error())
+		return ReturnInitFailed
+	}
+	topicRoutes := module.Routes()
+	routes = topicRoutes.Compile()
+	if m, ok := module.(Fallbacker); ok {
+		routes.Fallback = m.Fallback()
+	}
+	topics := make([]string, 0, len(topicRoutes))
+	for topic := range topicRoutes {
+		if !isTopicPattern(topic) {
+			topics = append(topics, topic)
+		}
+	}
+	sort.Strings(topics)
+	for _, topic := range topics {
+		if err := Subscribe(topic); err != nil {
+			LogError("subscribing", "topic", topic, "error", err.Error())
+			return ReturnSubscribeFailed
+		}
+	}
+	return ReturnOK
+}
+
+// Dispatch passes msg to the registered Module's routes. It's used by the recv
+// export once the message has been decoded and is useful for delivering
+// messages to a Module in tests. If a handler panics, the panic is recovered
+// as described for TopicRouter.Handle and ReturnHandlerPanicked is returned.
+func Dispatch(msg *BusMessage) int32 {
+	if module == nil {
+		return ReturnNoModule
+	}
+	if routes == nil {
+		// Start hasn't been called
+		return ReturnOK
+	}
+	if routes.handle(msg) {
+		return ReturnHandlerPanicked
+	}
+	return ReturnOK
+}
+
+// Shutdown calls Shutdown on the registered Module if it implements
+// Shutdowner. It implements the shutdown export.
+func Shutdown() int32 {
+	if module == nil {
+		return ReturnNoModule
+	}
+	s, ok := module.(Shutdowner)
+	if !ok {
+		return ReturnOK
+	}
+	if err := s.Shutdown(); err != nil {
+		LogError("shutting down module", "error", err.Error())
+		return ReturnShutdownFailed
+	}
+	return ReturnOK
+}
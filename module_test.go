@@ -0,0 +1,61 @@
+//go:build !wasm
+
+package core_test
+
+import (
+	"slices"
+	"testing"
+
+	core "github.com/autonomouskoi/core-tinygo"
+	"github.com/autonomouskoi/core-tinygo/coretest"
+)
+
+type testModule struct {
+	routes   core.TopicRouter
+	fallback core.Handler
+}
+
+func (m *testModule) Init() error { return nil }
+
+func (m *testModule) Routes() core.TopicRouter { return m.routes }
+
+func (m *testModule) Fallback() core.Handler { return m.fallback }
+
+func TestStartSubscriptions(t *testing.T) {
+	h := coretest.New(t)
+	r := core.TopicRouter{
+		"b":         {1: core.ReplyNotFound},
+		"a":         {1: core.ReplyNotFound},
+		"mod.{id}":  {1: core.ReplyNotFound},
+		"mod.*.all": {1: core.ReplyNotFound},
+	}
+	core.Register(&testModule{routes: r, fallback: core.ReplyNotFound})
+	if code := core.Start(); code != core.ReturnOK {
+		t.Fatalf("got return code %d", code)
+	}
+	if got, want := h.Subscriptions(), []string{"a", "b"}; !slices.Equal(got, want) {
+		t.Fatalf("subscribed to %q, want %q", got, want)
+	}
+}
+
+func TestDispatchReturnCodes(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		handler core.Handler
+		want    int32
+	}{
+		{"ok", func(*core.BusMessage) *core.BusMessage { return nil }, core.ReturnOK},
+		{"panic", func(*core.BusMessage) *core.BusMessage { panic("boom") }, core.ReturnHandlerPanicked},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			coretest.New(t)
+			core.Register(&testModule{routes: core.TopicRouter{"topic": {1: tc.handler}}})
+			if code := core.Start(); code != core.ReturnOK {
+				t.Fatalf("got start return code %d", code)
+			}
+			if got := core.Dispatch(&core.BusMessage{Topic: "topic", Type: 1}); got != tc.want {
+				t.Fatalf("got return code %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,14 @@
+//go:build wasm
+
+package core
+
+// Recv decodes the message provided by the host and passes it to Dispatch. It
+// implements the recv export.
+func Recv() int32 {
+	msg, err := UnmarshalInput()
+	if err != nil {
+		LogError("decoding input", "error", err.Error())
+		return ReturnDecodeFailed
+	}
+	return Dispatch(msg)
+}
@@ -0,0 +1,200 @@
+package core
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Topic patterns are TopicRouter keys made of segments separated by dots. A
+// segment of {name} matches any one segment, capturing it as the parameter
+// name. A segment of * matches any one segment without capturing it. A final
+// segment of {name...} matches one or more remaining segments, capturing them
+// joined by dots. Other segments must match exactly. For example,
+// "mymod.users.{id}" matches "mymod.users.1234" with the parameter id set to
+// "1234", and "mymod.{rest...}" matches any topic starting with "mymod.".
+//
+// An exact match for a topic always takes precedence over a pattern. When
+// several patterns match, the most specific wins: comparing segment by
+// segment, a literal beats a {name} or *, which beats a {name...}. Patterns
+// of equal specificity are ordered by their text.
+
+type segmentKind int
+
+const (
+	segmentLiteral segmentKind = iota
+	segmentParam
+	segmentRest
+)
+
+type patternSegment struct {
+	kind segmentKind
+	text string
+}
+
+type topicPattern struct {
+	pattern  string
+	segments []patternSegment
+}
+
+// compilePatterns returns the patterns in r sorted by precedence
+func compilePatterns(r TopicRouter) []*topicPattern {
+	var patterns []*topicPattern
+	for key := range r {
+		if isTopicPattern(key) {
+			patterns = append(patterns, parseTopicPattern(key))
+		}
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		return patterns[i].moreSpecific(patterns[j])
+	})
+	return patterns
+}
+
+// splitPattern splits a pattern into segments, keeping a final {name...}
+// segment intact despite the dots it contains.
+func splitPattern(pattern string) []string {
+	rest := ""
+	if strings.HasSuffix(pattern, "...}") {
+		if i := strings.LastIndex(pattern, "{"); i == 0 || (i > 0 && pattern[i-1] == '.') {
+			rest = pattern[i:]
+			pattern = strings.TrimSuffix(pattern[:i], ".")
+		}
+	}
+	var parts []string
+	if pattern != "" || rest == "" {
+		parts = strings.Split(pattern, ".")
+	}
+	if rest != "" {
+		parts = append(parts, rest)
+	}
+	return parts
+}
+
+// isTopicPattern reports whether a TopicRouter key is a pattern rather than a
+// literal topic
+func isTopicPattern(key string) bool {
+	for _, seg := range splitPattern(key) {
+		if seg == "*" || (strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}")) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseTopicPattern(pattern string) *topicPattern {
+	tp := &topicPattern{pattern: pattern}
+	parts := splitPattern(pattern)
+	for i, part := range parts {
+		seg := patternSegment{kind: segmentLiteral, text: part}
+		switch {
+		case part == "*":
+			seg = patternSegment{kind: segmentParam}
+		case strings.HasPrefix(part, "{") && strings.HasSuffix(part, "...}") && i == len(parts)-1:
+			seg = patternSegment{kind: segmentRest, text: part[1 : len(part)-4]}
+		case strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}"):
+			seg = patternSegment{kind: segmentParam, text: part[1 : len(part)-1]}
+		}
+		tp.segments = append(tp.segments, seg)
+	}
+	return tp
+}
+
+// match returns the parameters captured from topic and whether it matches
+func (tp *topicPattern) match(topic string) (map[string]string, bool) {
+	parts := strings.Split(topic, ".")
+	params := map[string]string{}
+	for i, seg := range tp.segments {
+		if seg.kind == segmentRest {
+			if i >= len(parts) {
+				return nil, false
+			}
+			for _, part := range parts[i:] {
+				if part == "" {
+					return nil, false
+				}
+			}
+			params[seg.text] = strings.Join(parts[i:], ".")
+			return params, true
+		}
+		if i >= len(parts) || parts[i] == "" {
+			return nil, false
+		}
+		switch seg.kind {
+		case segmentLiteral:
+			if parts[i] != seg.text {
+				return nil, false
+			}
+		case segmentParam:
+			if seg.text != "" {
+				params[seg.text] = parts[i]
+			}
+		}
+	}
+	if len(parts) != len(tp.segments) {
+		return nil, false
+	}
+	return params, true
+}
+
+// moreSpecific reports whether tp takes precedence over other
+func (tp *topicPattern) moreSpecific(other *topicPattern) bool {
+	for i := 0; i < len(tp.segments) && i < len(other.segments); i++ {
+		if a, b := tp.segments[i].kind, other.segments[i].kind; a != b {
+			return a < b
+		}
+	}
+	if len(tp.segments) != len(other.segments) {
+		return len(tp.segments) > len(other.segments)
+	}
+	return tp.pattern < other.pattern
+}
+
+// route finds the TypeRouter for topic, returning the parameters captured if
+// the topic matched a pattern.
+func (r *Router) route(topic string) (TypeRouter, map[string]string, bool) {
+	if tr, present := r.routes[topic]; present {
+		return tr, nil, true
+	}
+	if !r.compiled {
+		r.patterns, r.compiled = compilePatterns(r.routes), true
+	}
+	for _, tp := range r.patterns {
+		if params, ok := tp.match(topic); ok {
+			return r.routes[tp.pattern], params, true
+		}
+	}
+	return nil, nil, false
+}
+
+var (
+	topicParamsLock sync.Mutex
+	topicParams     = map[*BusMessage]map[string]string{}
+)
+
+// setTopicParams records the parameters captured from msg's topic until the
+// returned function is called
+func setTopicParams(msg *BusMessage, params map[string]string) func() {
+	topicParamsLock.Lock()
+	topicParams[msg] = params
+	topicParamsLock.Unlock()
+	return func() {
+		topicParamsLock.Lock()
+		delete(topicParams, msg)
+		topicParamsLock.Unlock()
+	}
+}
+
+// TopicParams returns the parameters captured from msg's topic by the
+// TopicRouter pattern it matched. It's only valid while msg is being handled.
+func TopicParams(msg *BusMessage) map[string]string {
+	topicParamsLock.Lock()
+	defer topicParamsLock.Unlock()
+	return topicParams[msg]
+}
+
+// TopicParam returns the named parameter captured from msg's topic. See
+// TopicParams.
+func TopicParam(msg *BusMessage, name string) string {
+	return TopicParams(msg)[name]
+}
@@ -0,0 +1,171 @@
+//go:build !wasm
+
+package core_test
+
+import (
+	"testing"
+
+	core "github.com/autonomouskoi/core-tinygo"
+	"github.com/autonomouskoi/core-tinygo/coretest"
+)
+
+// routeTo returns a TypeRouter whose handler records its name and the
+// parameters captured for the message
+func routeTo(name string, got *string, params *map[string]string) core.TypeRouter {
+	return core.TypeRouter{1: func(msg *core.BusMessage) *core.BusMessage {
+		*got = name
+		*params = core.TopicParams(msg)
+		return nil
+	}}
+}
+
+func TestTopicPatternPrecedence(t *testing.T) {
+	coretest.New(t)
+	var got string
+	var params map[string]string
+	r := core.TopicRouter{}
+	for _, key := range []string{
+		"mod.users.list",
+		"mod.users.{id}",
+		"mod.*.{id}",
+		"mod.{kind}.list",
+		"mod.{rest...}",
+		"{all...}",
+	} {
+		r[key] = routeTo(key, &got, &params)
+	}
+	for _, tc := range []struct {
+		topic      string
+		want       string
+		wantParams map[string]string
+	}{
+		{"mod.users.list", "mod.users.list", nil},
+		{"mod.users.7", "mod.users.{id}", map[string]string{"id": "7"}},
+		{"mod.groups.list", "mod.{kind}.list", map[string]string{"kind": "groups"}},
+		{"mod.groups.7", "mod.*.{id}", map[string]string{"id": "7"}},
+		{"mod.users.7.posts", "mod.{rest...}", map[string]string{"rest": "users.7.posts"}},
+		{"mod", "{all...}", map[string]string{"all": "mod"}},
+		{"", "", nil},
+		{"mod.", "", nil},
+		{"other.topic", "{all...}", map[string]string{"all": "other.topic"}},
+	} {
+		t.Run(tc.topic, func(t *testing.T) {
+			got, params = "", nil
+			r.Handle(&core.BusMessage{Topic: tc.topic, Type: 1})
+			if got != tc.want {
+				t.Fatalf("routed to %q, want %q", got, tc.want)
+			}
+			if len(params) != len(tc.wantParams) {
+				t.Fatalf("got params %v, want %v", params, tc.wantParams)
+			}
+			for name, value := range tc.wantParams {
+				if params[name] != value {
+					t.Errorf("param %s: got %q, want %q", name, params[name], value)
+				}
+			}
+		})
+	}
+}
+
+func TestTopicPatternRouterChanges(t *testing.T) {
+	coretest.New(t)
+	var got string
+	var params map[string]string
+	r := core.TopicRouter{"mod.{rest...}": routeTo("rest", &got, &params)}
+	msg := &core.BusMessage{Topic: "mod.users.7", Type: 1}
+	for _, tc := range []struct {
+		name   string
+		change func()
+		want   string
+	}{
+		{"initial", func() {}, "rest"},
+		{"pattern added", func() { r["mod.users.{id}"] = routeTo("id", &got, &params) }, "id"},
+		{"pattern replaced", func() {
+			delete(r, "mod.users.{id}")
+			r["mod.*.*"] = routeTo("wildcards", &got, &params)
+		}, "wildcards"},
+	} {
+		tc.change()
+		got = ""
+		r.Handle(msg)
+		if got != tc.want {
+			t.Fatalf("%s: routed to %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestTopicRouterFallback(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		fallback  core.Handler
+		topic     string
+		wantReply bool
+	}{
+		{"no fallback", nil, "unknown", false},
+		{"unknown topic", core.ReplyNotFound, "unknown", true},
+		{"unknown type", core.ReplyNotFound, "known", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := coretest.New(t)
+			r := core.TopicRouter{"known": {1: func(*core.BusMessage) *core.BusMessage { return nil }}}.Compile()
+			r.Fallback = tc.fallback
+			other := core.TopicRouter{}.Compile()
+			replyTo := int64(3)
+			r.Handle(&core.BusMessage{Topic: tc.topic, Type: 5, ReplyTo: &replyTo})
+			other.Handle(&core.BusMessage{Topic: tc.topic, Type: 5, ReplyTo: &replyTo})
+			replies := h.Replies()
+			if !tc.wantReply {
+				if len(replies) != 0 {
+					t.Fatalf("got %d replies, want none", len(replies))
+				}
+				return
+			}
+			if len(replies) != 1 {
+				t.Fatalf("got %d replies, want 1 from the router with the fallback", len(replies))
+			}
+			if code := replies[0].GetError().GetCode(); code != int32(core.CommonErrorCode_NOT_FOUND) {
+				t.Errorf("got code %d, want NOT_FOUND", code)
+			}
+		})
+	}
+}
+
+func TestRouterCompile(t *testing.T) {
+	coretest.New(t)
+	var got string
+	var params map[string]string
+	topics := core.TopicRouter{"mod.{rest...}": routeTo("rest", &got, &params)}
+	r := topics.Compile()
+	// keys added after Compile aren't seen, replaced handlers are
+	topics["mod.users.{id}"] = routeTo("id", &got, &params)
+	topics["mod.{rest...}"] = routeTo("replaced", &got, &params)
+	r.Handle(&core.BusMessage{Topic: "mod.users.7", Type: 1})
+	if got != "replaced" {
+		t.Fatalf("routed to %q, want %q", got, "replaced")
+	}
+}
+
+func TestRouterDropsLateReplies(t *testing.T) {
+	h := coretest.New(t)
+	r := core.TopicRouter{}.Compile()
+	r.Fallback = core.ReplyNotFound
+	request := &core.BusMessage{Topic: "x", Type: 1}
+	p, err := core.SendAsync(request, 0, func(*core.BusMessage) {
+		t.Error("callback called after Cancel")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Cancel()
+	replyTo := p.ReplyTo()
+	r.Handle(&core.BusMessage{Topic: "x", Type: 2, ReplyTo: &replyTo})
+	if replies := h.Replies(); len(replies) != 0 {
+		t.Fatalf("replied %d times to a late reply", len(replies))
+	}
+	// a request from another module still gets the fallback's reply
+	other := int64(3)
+	r.Handle(&core.BusMessage{Topic: "x", Type: 1, ReplyTo: &other})
+	if replies := h.Replies(); len(replies) != 1 {
+		t.Fatalf("got %d replies to a request, want 1", len(replies))
+	}
+}
@@ -1,5 +1,9 @@
 package core
 
+import (
+	"fmt"
+)
+
 // A Handler handles bus messages, optionally returning a reply
 type Handler func(*BusMessage) *BusMessage
 
@@ -17,21 +21,133 @@ func (r TypeRouter) Handle(msg *BusMessage) *BusMessage {
 }
 
 // A TopicRouter dispatches a message to the appropriate TypeHandler by topic.
+// Keys may be topic patterns, see TopicParams.
 type TopicRouter map[string]TypeRouter
 
+// A Router dispatches messages with a TopicRouter whose patterns have been
+// compiled, so they aren't sorted for each message. Create one with
+// TopicRouter.Compile.
+type Router struct {
+	// Fallback handles messages that don't match a topic or a type in the
+	// router. A returned reply is sent as it would be from any other handler.
+	// If Fallback is nil, such messages are dropped. Plugins that don't share
+	// their topics with other modules may want to set this to ReplyNotFound.
+	// Middleware added to the TopicRouter with Use doesn't wrap Fallback.
+	Fallback Handler
+	routes   TopicRouter
+	patterns []*topicPattern
+	compiled bool
+}
+
+// Compile creates a Router dispatching with r. Handlers added to or replaced
+// in r for existing keys are used by the Router, but the Router doesn't see
+// keys added to or removed from r after Compile.
+func (r TopicRouter) Compile() *Router {
+	return &Router{
+		routes:   r,
+		patterns: compilePatterns(r),
+		compiled: true,
+	}
+}
+
+// ReplyNotFound is a Handler that replies to messages with a ReplyTo with a
+// CommonErrorCode_NOT_FOUND error. Messages without a ReplyTo get no reply.
+func ReplyNotFound(msg *BusMessage) *BusMessage {
+	if msg.ReplyTo == nil {
+		return nil
+	}
+	return ErrorReply(msg, CommonErrorCode_NOT_FOUND,
+		fmt.Sprintf("no handler for topic %q type %d", msg.GetTopic(), msg.GetType()))
+}
+
+// RepanicHandlers causes TopicRouter.Handle to panic again after handling a
+// panic from a handler. This can be useful in debugging builds to get a stack
+// trace from the host.
+var RepanicHandlers bool
+
+// ErrorCodeHandlerPanic is the Error.Code of the reply sent when a handler
+// panics. Since this is not a CommonErrorCode, the Error's NotCommonError is
+// set.
+const ErrorCodeHandlerPanic int32 = -1
+
 // Handle a message using the TypeHandler for the type. If there's no handler
-// for the topic no action is taken.
+// for the topic or type the message is dropped. Replies to requests sent with
+// SendAsync are passed to their callbacks instead. If a handler panics, the
+// panic is logged and, if msg has a ReplyTo, an Error reply with code
+// ErrorCodeHandlerPanic is sent. Patterns in r are sorted for each message
+// that doesn't match a topic exactly; use Compile for a router that handles
+// many messages.
 func (r TopicRouter) Handle(msg *BusMessage) {
-	tr, present := r[msg.GetTopic()]
-	if !present {
+	(&Router{routes: r}).handle(msg)
+}
+
+// Handle a message as TopicRouter.Handle does, passing messages that don't
+// match a topic or type to Fallback. Late replies to requests sent with
+// SendAsync, whose requests timed out or were cancelled, are dropped rather
+// than passed to Fallback.
+func (r *Router) Handle(msg *BusMessage) {
+	r.handle(msg)
+}
+
+// handle implements Handle, reporting whether a handler panicked
+func (r *Router) handle(msg *BusMessage) (panicked bool) {
+	defer recoverHandler(msg, msg.ReplyTo != nil && pendingFor(msg) == nil, &panicked)
+	if HandleReply(msg) {
 		return
 	}
-	reply := tr.Handle(msg)
+	var handler Handler
+	tr, params, present := r.route(msg.GetTopic())
+	if present {
+		handler = tr[msg.GetType()]
+	}
+	if handler == nil {
+		if r.Fallback == nil || isLateReply(msg) {
+			return
+		}
+		handler = r.Fallback
+	}
+	if params != nil {
+		defer setTopicParams(msg, params)()
+	}
+	reply := handler(msg)
 	if reply == nil {
 		return
 	}
 	reply.ReplyTo = msg.ReplyTo
 	SendReply(reply)
+	return
+}
+
+// recoverHandler recovers a panic from handling msg, logging it, setting
+// panicked, and sending an error reply if sendReply is true.
+func recoverHandler(msg *BusMessage, sendReply bool, panicked *bool) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	*panicked = true
+	LogError("handler panicked",
+		"topic", msg.GetTopic(),
+		"type", msg.GetType(),
+		"from_mod", msg.GetFromMod(),
+		"panic", fmt.Sprint(v),
+	)
+	if sendReply {
+		detail := "handler panicked"
+		userMessage := "An internal error occurred"
+		reply := DefaultReply(msg)
+		reply.Error = &Error{
+			Code:           ErrorCodeHandlerPanic,
+			Detail:         &detail,
+			UserMessage:    &userMessage,
+			NotCommonError: true,
+		}
+		reply.ReplyTo = msg.ReplyTo
+		SendReply(reply)
+	}
+	if RepanicHandlers {
+		panic(v)
+	}
 }
 
 // DefaultReply creates a template reply by copying msg's topic and incrementing
@@ -71,3 +187,44 @@ func UnmarshalMessage(msg *BusMessage, v Unmarshaller) *Error {
 	}
 	return nil
 }
+
+// Handle registers a typed handler for msgType in r. The request is
+// unmarshalled into a REQ and passed to fn. The reply is created with
+// DefaultReply and either has the RESP returned by fn marshalled into it or
+// has its Error set to the *Error returned by fn. If the request can't be
+// unmarshalled, fn is not called and the reply has a CommonErrorCode_INVALID_TYPE
+// error.
+func Handle[M any, REQ UnmarshallerPTR[M], RESP Marshaller](
+	r TypeRouter, msgType int32, fn func(REQ) (RESP, *Error),
+) {
+	r[msgType] = func(msg *BusMessage) *BusMessage {
+		reply := DefaultReply(msg)
+		var req M
+		if reply.Error = UnmarshalMessage(msg, REQ(&req)); reply.Error != nil {
+			return reply
+		}
+		resp, busErr := fn(&req)
+		if busErr != nil {
+			reply.Error = busErr
+			return reply
+		}
+		MarshalMessage(reply, resp)
+		return reply
+	}
+}
+
+// HandleEvent registers a typed handler for msgType in r for messages that
+// don't get a reply. The message is unmarshalled into a REQ and passed to fn.
+// If the message can't be unmarshalled, fn is not called.
+func HandleEvent[M any, REQ UnmarshallerPTR[M]](
+	r TypeRouter, msgType int32, fn func(REQ),
+) {
+	r[msgType] = func(msg *BusMessage) *BusMessage {
+		var req M
+		if UnmarshalMessage(msg, REQ(&req)) != nil {
+			return nil
+		}
+		fn(&req)
+		return nil
+	}
+}
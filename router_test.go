@@ -0,0 +1,98 @@
+//go:build !wasm
+
+package core_test
+
+import (
+	"strings"
+	"testing"
+
+	core "github.com/autonomouskoi/core-tinygo"
+	"github.com/autonomouskoi/core-tinygo/coretest"
+)
+
+func TestHandlePanic(t *testing.T) {
+	r := core.TopicRouter{"topic": {5: func(*core.BusMessage) *core.BusMessage {
+		panic("secret detail")
+	}}}
+	for _, tc := range []struct {
+		name      string
+		replyTo   *int64
+		wantReply bool
+	}{
+		{"request", func() *int64 { v := int64(3); return &v }(), true},
+		{"event", nil, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := coretest.New(t)
+			r.Handle(&core.BusMessage{Topic: "topic", Type: 5, FromMod: "other", ReplyTo: tc.replyTo})
+
+			logs := h.Logs()
+			if len(logs) != 1 || logs[0].GetLevel() != core.LogLevel_ERROR {
+				t.Fatalf("got logs %v, want one error", logs)
+			}
+			args := map[string]any{}
+			for _, arg := range logs[0].GetArgs() {
+				switch v := arg.GetValue().(type) {
+				case *core.LogSendRequest_Arg_String_:
+					args[arg.GetKey()] = v.String_
+				case *core.LogSendRequest_Arg_Int64:
+					args[arg.GetKey()] = v.Int64
+				}
+			}
+			for key, want := range map[string]any{
+				"topic":    "topic",
+				"type":     int64(5),
+				"from_mod": "other",
+				"panic":    "secret detail",
+			} {
+				if args[key] != want {
+					t.Errorf("log arg %s: got %v, want %v", key, args[key], want)
+				}
+			}
+
+			replies := h.Replies()
+			if !tc.wantReply {
+				if len(replies) != 0 {
+					t.Fatalf("got %d replies, want none", len(replies))
+				}
+				return
+			}
+			if len(replies) != 1 {
+				t.Fatalf("got %d replies, want 1", len(replies))
+			}
+			reply := replies[0]
+			if reply.GetTopic() != "topic" || reply.GetType() != 6 || reply.GetReplyTo() != *tc.replyTo {
+				t.Errorf("got topic %q type %d ReplyTo %d", reply.GetTopic(), reply.GetType(), reply.GetReplyTo())
+			}
+			busErr := reply.GetError()
+			if busErr.GetCode() != core.ErrorCodeHandlerPanic || !busErr.GetNotCommonError() {
+				t.Errorf("got code %d, NotCommonError %t", busErr.GetCode(), busErr.GetNotCommonError())
+			}
+			if msg := busErr.GetUserMessage(); msg == "" || strings.Contains(msg, "secret") {
+				t.Errorf("got user message %q", msg)
+			}
+		})
+	}
+}
+
+func TestRepanicHandlers(t *testing.T) {
+	h := coretest.New(t)
+	core.RepanicHandlers = true
+	defer func() { core.RepanicHandlers = false }()
+	r := core.TopicRouter{"topic": {1: func(*core.BusMessage) *core.BusMessage {
+		panic("boom")
+	}}}
+	replyTo := int64(3)
+	func() {
+		defer func() {
+			if v := recover(); v != "boom" {
+				t.Errorf("recovered %v, want the handler's panic", v)
+			}
+		}()
+		r.Handle(&core.BusMessage{Topic: "topic", Type: 1, ReplyTo: &replyTo})
+	}()
+	// the panic is still logged and replied to first
+	if len(h.Logs()) != 1 || len(h.Replies()) != 1 {
+		t.Errorf("got %d logs and %d replies, want 1 each", len(h.Logs()), len(h.Replies()))
+	}
+}
@@ -6,20 +6,25 @@ import (
 
 	"github.com/autonomouskoi/akcore"
 	bus "github.com/autonomouskoi/core-tinygo"
+	_ "github.com/autonomouskoi/core-tinygo/export"
 )
 
 func main() {}
 
-//go:export start
-func Start() int32 {
+func init() {
+	bus.Register(testModule{})
+}
+
+type testModule struct{}
+
+func (testModule) Init() error {
 	TestKVSetGetDelete()
 	TestKVList()
-	return 0
+	return nil
 }
 
-//go:export recv
-func Recv() int32 {
-	return 0
+func (testModule) Routes() bus.TopicRouter {
+	return nil
 }
 
 func SendMessage(testName, error string) {